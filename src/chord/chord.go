@@ -58,20 +58,22 @@ type Delegate interface {
 
 // Configuration for Chord nodes
 type Config struct {
-	Hostname      string           // Local host name
-	NumVnodes     int              // Number of Vnodes per physical node
-	HashFunc      func() hash.Hash // Hash function to use
-	StabilizeMin  time.Duration    // Minimum stabilization time
-	StabilizeMax  time.Duration    // Maximum stabilization time
-	NumSuccessors int              // Number of Successors to maintain
-	Delegate      Delegate         // Invoked to handle Ring events
-	Hashbits      int              // Bit size of the hash function
+	Hostname      string            // Local host name
+	NumVnodes     int               // Number of Vnodes per physical node
+	HashFunc      func() hash.Hash  // Hash function to use
+	StabilizeMin  time.Duration     // Minimum stabilization time
+	StabilizeMax  time.Duration     // Maximum stabilization time
+	NumSuccessors int               // Number of Successors to maintain
+	Delegate      Delegate          // Invoked to handle Ring events
+	Hashbits      int               // Bit size of the hash function
+	Meta          map[string]string // Metadata advertised with every local Vnode
 }
 
 // Represents an Vnode, local or remote
 type Vnode struct {
-	Id   []byte // Virtual ID
-	Host string // Host identifier
+	Id   []byte            // Virtual ID
+	Host string            // Host identifier
+	Meta map[string]string // Metadata advertised by the host
 }
 
 // Represents a local Vnode
@@ -106,6 +108,7 @@ func DefaultConfig(hostname string) *Config {
 		8,   // 8 Successors
 		nil, // No delegate
 		160, // 160bit hash function
+		nil, // No metadata
 	}
 }
 
@@ -197,16 +200,19 @@ func (r *Ring) Shutdown() {
 
 // Does a key lookup for up to N Successors of a key
 func (r *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
+	// Hash the key
+	h := r.Config.HashFunc()
+	h.Write(key)
+	return r.LookupHash(n, h.Sum(nil))
+}
+
+// Does a lookup for up to N successors of a key that is already hashed
+func (r *Ring) LookupHash(n int, key_hash []byte) ([]*Vnode, error) {
 	// Ensure that n is sane
 	if n > r.Config.NumSuccessors {
 		return nil, fmt.Errorf("Cannot ask for more Successors than NumSuccessors!")
 	}
 
-	// Hash the key
-	h := r.Config.HashFunc()
-	h.Write(key)
-	key_hash := h.Sum(nil)
-
 	// Find the nearest local vnode
 	nearest := r.nearestVnode(key_hash)
 
@@ -20,6 +20,7 @@ func (vn *localVnode) init(idx int) {
 
 	// Set our host
 	vn.Host = vn.Ring.Config.Hostname
+	vn.Meta = vn.Ring.Config.Meta
 
 	// Initialize all state
 	vn.Successors = make([]*Vnode, vn.Ring.Config.NumSuccessors)
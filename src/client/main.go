@@ -12,18 +12,17 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Product is a gathered product together with the storage nodes holding a copy
 type Product struct {
-	Name        string
-	Price       float64
-	URL         string
-	Description string
-	Rating      string
-	Addresses   []string
+	common.Product
+	Addresses []string
 }
 
 func failOnError(err error, msg string) {
@@ -79,9 +78,33 @@ func processInput(input string) {
 	case "scrap":
 		scrap(params)
 	case "gather":
-		gather()
+		gather(params)
+	case "history":
+		history(params)
+	case "product":
+		showProduct(params)
+	case "query":
+		query(params)
+	case "indexes":
+		indexes()
+	case "offers":
+		offers(params)
+	case "watch":
+		watch(params)
+	case "changes":
+		changes(params)
+	case "replication":
+		replication(params)
+	case "export":
+		export(params)
+	case "ownership":
+		ownership(params)
+	case "search":
+		search(params)
+	case "delete":
+		deleteProduct(params)
 	case "help":
-		fmt.Println("Available commands: scrap, gather, help, exit")
+		fmt.Println("Available commands: scrap, gather, history, product, query, indexes, offers, watch, changes, replication, ownership, export, search, delete, help, exit")
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 	}
@@ -142,13 +165,38 @@ func insertIntoQueue(urlMessage common.URLMessage) {
 	}
 }
 
-func gather() {
+func gather(params []string) {
+	grouped := len(params) > 0 && params[0] == "offers"
+
+	productMap := gatherProducts()
+
+	if grouped {
+		products := make([]common.Product, 0, len(productMap))
+		for _, product := range productMap {
+			products = append(products, product.Product)
+		}
+		printOfferGroups(common.GroupOffers(products))
+		return
+	}
+
+	// Printing the table, tabs and line breaks in the fields are escaped so every
+	// product stays on its line
+	fmt.Println("URL\tName\tDescription\tPrice\tAddresses")
+	for _, product := range productMap {
+		fmt.Printf("%s\t%s\t%s\t%.2f\t%s\n", common.EscapeTSV(product.URL), common.EscapeTSV(product.Name),
+			common.EscapeTSV(product.Description), product.Price, strings.Join(product.Addresses, ", "))
+	}
+}
+
+// gatherProducts reads the products of every storage node, keeping the newest
+// version of each one
+func gatherProducts() map[string]*Product {
 	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
 	if err != nil {
 		log.Fatalf("Error while discovering storage nodes %s", err.Error())
 	}
 
-	fmt.Printf("[*] While gathering, found %d different storage nodes\n", len(storeIps))
+	fmt.Fprintf(os.Stderr, "[*] While gathering, found %d different storage nodes\n", len(storeIps))
 
 	productMap := make(map[string]*Product)
 	var mu sync.Mutex
@@ -159,46 +207,1020 @@ func gather() {
 		// Modify the original goroutine to use the retry mechanism
 		go func(ip string) {
 			defer wg.Done()
-			url := fmt.Sprintf("http://%s:10001/gather", ip)
-			body, err := doRequestWithRetry(url, 3) // Retry up to 3 times
+			// Products are merged as they arrive, a page at a time
+			err := streamGather(ip, func(product common.Product) {
+				mu.Lock()
+				defer mu.Unlock()
+				mergeProduct(productMap, product, ip)
+			})
 			if err != nil {
 				log.Printf("Error fetching from %s: %s", ip, err.Error())
-				return
 			}
+		}(ip)
+	}
+
+	wg.Wait()
+	return productMap
+}
+
+// export writes every product of the cluster to a file, or to the standard output
+// without out=, as csv, tsv, ndjson or pretty printed json
+func export(params []string) {
+	format := common.ExportCSV
+	rawColumns := ""
+	out := ""
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			fmt.Println("Usage: cli export [format=csv|tsv|ndjson|json] [columns=<name,price,...>] [out=<file>]")
+			return
+		}
+		switch parts[0] {
+		case "format":
+			format = parts[1]
+		case "columns":
+			rawColumns = parts[1]
+		case "out":
+			out = parts[1]
+		default:
+			fmt.Printf("Unknown option %s\n", parts[0])
+			return
+		}
+	}
+
+	if !common.ValidExportFormat(format) {
+		fmt.Printf("Unknown format %s\n", format)
+		return
+	}
+
+	columns, err := common.ParseExportColumns(rawColumns)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Printf("Available columns: %s\n", strings.Join(common.ExportColumns, ","))
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Printf("Failed to create %s: %s\n", out, err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	exporter, err := common.NewExporter(w, format, columns)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	productMap := gatherProducts()
+	products := make([]common.Product, 0, len(productMap))
+	for _, product := range productMap {
+		products = append(products, product.Product)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].Name < products[j].Name
+	})
+
+	for _, product := range products {
+		if err := exporter.Write(product); err != nil {
+			fmt.Printf("Failed to write %s: %s\n", product.Name, err)
+			return
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		fmt.Printf("Failed to finish the export: %s\n", err)
+		return
+	}
+
+	if out != "" {
+		fmt.Printf("Exported %d products to %s\n", len(products), out)
+	}
+}
+
+// mergeProduct adds a product received from a storage node to the map of products by URL
+func mergeProduct(productMap map[string]*Product, product common.Product, ip string) {
+	if existingProduct, ok := productMap[product.URL]; ok {
+		existingProduct.Addresses = append(existingProduct.Addresses, ip)
+
+		// Replicas may lag behind, show the newest version
+		if product.Version.Compare(existingProduct.Version) > 0 {
+			existingProduct.Product = product
+		}
+		return
+	}
+
+	newProduct := Product{
+		Product:   product,
+		Addresses: []string{ip}, // Initialize with current IP
+	}
+
+	productMap[product.URL] = &newProduct
+}
+
+// Number of products requested per page while gathering
+const gatherPageSize = 500
+
+// streamGather reads every product of a storage node page by page, decoding them
+// one at a time from the NDJSON stream
+func streamGather(ip string, handle func(product common.Product)) error {
+	cursor := ""
+	for {
+		url := fmt.Sprintf("http://%s:10001/gather?format=ndjson&limit=%d&cursor=%s", ip, gatherPageSize, url.QueryEscape(cursor))
+		resp, err := getWithRetry(url, 3)
+		if err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var product common.Product
+			err := decoder.Decode(&product)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				resp.Body.Close()
+				return err
+			}
+			handle(product)
+		}
+
+		// The cursor of the next page is only known once the body was consumed
+		cursor = resp.Trailer.Get("X-Next-Cursor")
+		resp.Body.Close()
+
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+func getWithRetry(url string, maxRetries int) (*http.Response, error) {
+	backoff := 1 * time.Second // Initial backoff duration
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		resp, err := http.Get(url)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("unexpected response status: %s", resp.Status)
+			resp.Body.Close()
+		}
+
+		if attempt < maxRetries-1 {
+			time.Sleep(backoff)
+			backoff *= 2 // Exponential backoff
+		}
+	}
+
+	return nil, lastErr
+}
+
+func showProduct(params []string) {
+	if len(params) == 0 {
+		fmt.Println("Usage: cli product <product name>")
+		return
+	}
+
+	key := strings.Join(params, " ")
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	// Any storage node can route the request, try them until one answers
+	for _, ip := range storeIps {
+		product, err := common.GetProduct(ip+":10001", key)
+		if err == common.ErrProductNotFound {
+			fmt.Printf("Product %s not found\n", key)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching from %s: %s", ip, err.Error())
+			continue
+		}
+
+		fmt.Printf("Name: %s\n", product.Name)
+		fmt.Printf("Source: %s\n", product.Source)
+		fmt.Printf("SKU: %s\n", product.SKU)
+		fmt.Printf("Category: %s\n", product.Category)
+		fmt.Printf("Price: %.2f %s\n", product.Price, product.Currency)
+		fmt.Printf("Availability: %s\n", product.Availability)
+		fmt.Printf("Rating: %.1f (%d reviews)\n", product.RatingValue, product.ReviewCount)
+		fmt.Printf("URL: %s\n", product.URL)
+		for _, image := range product.Images {
+			fmt.Printf("Image: %s\n", image)
+		}
+		if !product.ScrapedAt.IsZero() {
+			fmt.Printf("Scraped at: %s\n", product.ScrapedAt.Format(time.RFC3339))
+		}
+		fmt.Printf("Description: %s\n", product.Description)
+		fmt.Printf("Version: %s\n", product.Version)
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+func query(params []string) {
+	values := url.Values{}
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			fmt.Println("Usage: cli query [min_price=<n>] [max_price=<n>] [min_rating=<n>] [source=<store>] [category=<category>] [price_band=<0-100|100-250|250-500|500-1000|1000+>] [name=<text>] [sort=<price|-price|rating|-rating|name|-name>] [limit=<n>] [group=offers]")
+			return
+		}
+		values.Set(parts[0], parts[1])
+	}
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	// The node receiving the query scatters it to the rest of the cluster
+	for _, ip := range storeIps {
+		url := fmt.Sprintf("http://%s:10001/query?%s", ip, values.Encode())
+		body, err := doRequestWithRetry(url, 3)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			continue
+		}
 
-			var products []Product
-			if err := json.Unmarshal(body, &products); err != nil {
+		if values.Get("group") == "offers" {
+			var groups []common.OfferGroup
+			if err := json.Unmarshal(body, &groups); err != nil {
 				log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+				continue
+			}
+			printOfferGroups(groups)
+			return
+		}
+
+		var products []common.Product
+		if err := json.Unmarshal(body, &products); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			continue
+		}
+
+		fmt.Println("Name\tPrice\tRating\tCategory\tURL")
+		for _, product := range products {
+			fmt.Printf("%s\t%.2f\t%s\t%s\t%s\n", product.Name, product.Price, product.Rating, product.Category, product.URL)
+		}
+		return
+	}
+
+	fmt.Println("No storage node could answer the query")
+}
+
+// offers prints the listings of the same item as the product in every store
+func offers(params []string) {
+	if len(params) == 0 {
+		fmt.Println("Usage: cli offers <product name>")
+		return
+	}
+
+	key := strings.Join(params, " ")
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		body, err := doRequestWithRetry(fmt.Sprintf("http://%s:10001/offers?key=%s", ip, url.QueryEscape(key)), 3)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			continue
+		}
+
+		var group common.OfferGroup
+		if err := json.Unmarshal(body, &group); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			continue
+		}
+
+		printOfferGroups([]common.OfferGroup{group})
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+func printOfferGroups(groups []common.OfferGroup) {
+	for _, group := range groups {
+		fmt.Printf("%s\t%s\tfrom %.2f\t%d offers\n", group.Title, group.Category, group.LowestPrice, len(group.Offers))
+		for _, offer := range group.Offers {
+			fmt.Printf("\t%s\t%.2f %s\t%s\t%.2f\t%s\n", offer.Source, offer.Price, offer.Currency, offer.Availability, offer.Score, offer.URL)
+		}
+	}
+}
+
+// indexes prints how many products the cluster has for every source, category
+// and price band
+func indexes() {
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		body, err := doRequestWithRetry(fmt.Sprintf("http://%s:10001/indexes", ip), 3)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			continue
+		}
+
+		var counts map[string]map[string]int
+		if err := json.Unmarshal(body, &counts); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			continue
+		}
+
+		dimensions := make([]string, 0, len(counts))
+		for dimension := range counts {
+			dimensions = append(dimensions, dimension)
+		}
+		sort.Strings(dimensions)
+
+		for _, dimension := range dimensions {
+			values := make([]string, 0, len(counts[dimension]))
+			for value := range counts[dimension] {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+
+			fmt.Printf("%s:\n", dimension)
+			for _, value := range values {
+				fmt.Printf("\t%s\t%d\n", value, counts[dimension][value])
+			}
+		}
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+func deleteProduct(params []string) {
+	if len(params) == 0 {
+		fmt.Println("Usage: cli delete <product name>")
+		return
+	}
+
+	key := url.QueryEscape(strings.Join(params, " "))
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	// Any storage node can coordinate the deletion
+	for _, ip := range storeIps {
+		url := fmt.Sprintf("http://%s:10001/delete?key=%s", ip, key)
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
+		failOnError(err, "Failed to create request")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Error deleting on %s: %s", ip, err.Error())
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Deletion failed: %s", body)
+			return
+		}
+
+		fmt.Printf("Deleted %s\n", strings.Join(params, " "))
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+const watchUsage = `Usage:
+  cli watch add (key=<product name>|query=<filters>) threshold=<price> [sink=<log|webhook|queue>] [target=<url or topic>]
+  cli watch list
+  cli watch remove <id>`
+
+func watch(params []string) {
+	if len(params) == 0 {
+		fmt.Println(watchUsage)
+		return
+	}
+
+	switch params[0] {
+	case "add":
+		addWatch(params[1:])
+	case "list":
+		listWatches()
+	case "remove":
+		if len(params) != 2 {
+			fmt.Println(watchUsage)
+			return
+		}
+		removeWatch(params[1])
+	default:
+		fmt.Println(watchUsage)
+	}
+}
+
+func addWatch(params []string) {
+	var rule common.WatchRule
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			fmt.Println(watchUsage)
+			return
+		}
+
+		switch parts[0] {
+		case "key":
+			rule.Key = parts[1]
+		case "query":
+			rule.Query = parts[1]
+		case "threshold":
+			threshold, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				fmt.Printf("Invalid threshold %s\n", parts[1])
 				return
 			}
+			rule.Threshold = threshold
+		case "sink":
+			rule.Sink = parts[1]
+		case "target":
+			rule.Target = parts[1]
+		default:
+			fmt.Println(watchUsage)
+			return
+		}
+	}
+
+	payload, err := json.Marshal(rule)
+	failOnError(err, "Failed to marshal JSON")
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		resp, err := http.Post(fmt.Sprintf("http://%s:10001/watch", ip), "application/json", bytes.NewBuffer(payload))
+		if err != nil {
+			log.Printf("Error adding watch rule on %s: %s", ip, err.Error())
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Adding the watch rule failed: %s", body)
+			return
+		}
+
+		var created common.WatchRule
+		if err := json.Unmarshal(body, &created); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			return
+		}
+		fmt.Printf("Added watch rule %s\n", created.ID)
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+func listWatches() {
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		body, err := doRequestWithRetry(fmt.Sprintf("http://%s:10001/watch", ip), 3)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			continue
+		}
+
+		var rules []common.WatchRule
+		if err := json.Unmarshal(body, &rules); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			continue
+		}
+
+		fmt.Println("ID\tWatching\tThreshold\tSink\tCreated")
+		for _, rule := range rules {
+			watching := "key=" + rule.Key
+			if rule.Query != "" {
+				watching = "query=" + rule.Query
+			}
+			sink := rule.Sink
+			if rule.Target != "" {
+				sink += " " + rule.Target
+			}
+			fmt.Printf("%s\t%s\t%.2f\t%s\t%s\n", rule.ID, watching, rule.Threshold, sink, rule.Created.Format(time.RFC3339))
+		}
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+func removeWatch(id string) {
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:10001/watch?id=%s", ip, url.QueryEscape(id)), nil)
+		failOnError(err, "Failed to create request")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Error removing watch rule on %s: %s", ip, err.Error())
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Removing the watch rule failed: %s", body)
+			return
+		}
+
+		fmt.Printf("Removed watch rule %s\n", id)
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+// How long a storage node holds a request for changes while following
+const changesWait = 30 * time.Second
+
+var changesClient = &http.Client{Timeout: changesWait + 30*time.Second}
+
+// changes prints the changes of the whole cluster as NDJSON. Every storage node
+// has its own feed, which includes the writes it received as a replica, so a
+// change is printed only the first time one of the owners reports it.
+func changes(params []string) {
+	follow := false
+	cursorsFile := ""
+	for _, param := range params {
+		switch {
+		case param == "follow":
+			follow = true
+		case strings.HasPrefix(param, "cursors="):
+			cursorsFile = strings.TrimPrefix(param, "cursors=")
+		default:
+			fmt.Println("Usage: cli changes [follow] [cursors=<file>]")
+			return
+		}
+	}
+
+	// The cursors file lets the next run resume where this one stopped
+	cursors := make(map[string]uint64)
+	if cursorsFile != "" {
+		if data, err := os.ReadFile(cursorsFile); err == nil {
+			if err := json.Unmarshal(data, &cursors); err != nil {
+				log.Printf("Ignoring unreadable cursors file %s: %s", cursorsFile, err.Error())
+			}
+		}
+	}
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	newest := make(map[string]common.Version)
+	encoder := json.NewEncoder(os.Stdout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	saveCursors := func() {
+		if cursorsFile == "" {
+			return
+		}
+		data, _ := json.Marshal(cursors)
+		if err := os.WriteFile(cursorsFile, data, 0644); err != nil {
+			log.Printf("Error saving cursors to %s: %s", cursorsFile, err.Error())
+		}
+	}
+
+	for _, ip := range storeIps {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
 
 			mu.Lock()
-			defer mu.Unlock()
-			for _, product := range products {
-				if existingProduct, ok := productMap[product.URL]; ok {
-					existingProduct.Addresses = append(existingProduct.Addresses, ip)
-				} else {
-					newProduct := Product{
-						Name:        product.Name,
-						Price:       product.Price,
-						URL:         product.URL,
-						Description: product.Description,
-						Rating:      product.Rating,
-						Addresses:   []string{ip}, // Initialize with current IP
-					}
+			cursor := cursors[ip]
+			mu.Unlock()
+
+			err := followChanges(ip, cursor, follow, func(batch []common.Change, next uint64) {
+				mu.Lock()
+				defer mu.Unlock()
 
-					productMap[product.URL] = &newProduct
+				for _, change := range batch {
+					if current, ok := newest[change.Key]; ok && current.Compare(change.Version) >= 0 {
+						continue
+					}
+					newest[change.Key] = change.Version
+					encoder.Encode(change)
 				}
+				cursors[ip] = next
+				saveCursors()
+			})
+			if err != nil {
+				log.Printf("Error following the changes of %s: %s", ip, err.Error())
 			}
 		}(ip)
 	}
 
 	wg.Wait()
+}
 
-	// Printing the table
-	fmt.Println("URL\tName\tDescription\tPrice\tAddresses")
-	for _, product := range productMap {
-		fmt.Printf("%s\t%s\t%s\t%.2f\t%s\n", product.URL, product.Name, product.Description, product.Price, strings.Join(product.Addresses, ", "))
+// followChanges reads the change feed of a storage node from the cursor until it
+// is drained, or forever when following
+func followChanges(ip string, cursor uint64, follow bool, handle func(batch []common.Change, next uint64)) error {
+	for {
+		endpoint := fmt.Sprintf("http://%s:10001/changes?cursor=%d", ip, cursor)
+		if follow {
+			endpoint += "&wait=" + changesWait.String()
+		}
+
+		resp, err := changesClient.Get(endpoint)
+		if err != nil {
+			if !follow {
+				return err
+			}
+			log.Printf("Error reading the changes of %s, retrying: %s", ip, err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusGone {
+			// The node lost or trimmed its log, what happened before the cursor
+			// it sends back is only available through a gather
+			resp.Body.Close()
+			next, err := strconv.ParseUint(resp.Header.Get("X-Next-Cursor"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("the changes of %s after %d are gone", ip, cursor)
+			}
+			log.Printf("The changes of %s after %d are gone, run gather to catch up. Following from %d", ip, cursor, next)
+			cursor = next
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+
+		var batch []common.Change
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var change common.Change
+			if err := decoder.Decode(&change); err == io.EOF {
+				break
+			} else if err != nil {
+				resp.Body.Close()
+				return err
+			}
+			batch = append(batch, change)
+		}
+		resp.Body.Close()
+
+		next, err := strconv.ParseUint(resp.Header.Get("X-Next-Cursor"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cursor: %s", resp.Header.Get("X-Next-Cursor"))
+		}
+
+		if len(batch) > 0 {
+			handle(batch, next)
+		}
+		cursor = next
+
+		if len(batch) == 0 && !follow {
+			return nil
+		}
+	}
+}
+
+// replication shows the replication factor of the cluster or changes it, the
+// storage nodes add or remove replicas in the background to match
+func replication(params []string) {
+	method := http.MethodGet
+	var body []byte
+
+	if len(params) > 0 {
+		if params[0] != "set" || len(params) < 2 {
+			fmt.Println("Usage: cli replication [set replicas=<n> [read_quorum=<n>] [write_quorum=<n>]]")
+			return
+		}
+
+		var config common.ReplicationConfig
+		for _, param := range params[1:] {
+			parts := strings.SplitN(param, "=", 2)
+			value := 0
+			if len(parts) == 2 {
+				value, _ = strconv.Atoi(parts[1])
+			}
+			if value <= 0 {
+				fmt.Printf("Invalid setting %s\n", param)
+				return
+			}
+
+			switch parts[0] {
+			case "replicas":
+				config.Replicas = value
+			case "read_quorum":
+				config.ReadQuorum = value
+			case "write_quorum":
+				config.WriteQuorum = value
+			default:
+				fmt.Printf("Unknown setting %s\n", parts[0])
+				return
+			}
+		}
+
+		var err error
+		body, err = json.Marshal(config)
+		failOnError(err, "Failed to marshal JSON")
+		method = http.MethodPut
+	}
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s:10001/admin/replication", ip), bytes.NewBuffer(body))
+		failOnError(err, "Failed to create request")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			continue
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Request failed: %s", respBody)
+			return
+		}
+
+		var config common.ReplicationConfig
+		if err := json.Unmarshal(respBody, &config); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			return
+		}
+		fmt.Printf("Replicas: %d\tRead quorum: %d\tWrite quorum: %d\n", config.Replicas, config.ReadQuorum, config.WriteQuorum)
+		return
+	}
+
+	fmt.Println("No storage node could answer the request")
+}
+
+// ownership gathers the ownership report of every storage node. Each key is
+// reported by its primary owner, or by a replica when the primary has no copy,
+// so together they cover the cluster. With
+// without=<host> it tells whether that host can be taken down without losing the
+// last copy of a key, with key=<key> it shows where the replicas of the key are.
+func ownership(params []string) {
+	values := url.Values{}
+	key := ""
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || (parts[0] != "without" && parts[0] != "key") {
+			fmt.Println("Usage: cli ownership [without=<host>] [key=<key>]")
+			return
+		}
+		if parts[0] == "key" {
+			key = parts[1]
+		}
+		values.Set(parts[0], parts[1])
+	}
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	if key != "" {
+		for _, ip := range storeIps {
+			body, err := doRequestWithRetry(fmt.Sprintf("http://%s:10001/admin/placement?%s", ip, values.Encode()), 3)
+			if err != nil {
+				log.Printf("Error querying %s: %s", ip, err.Error())
+				continue
+			}
+
+			var placement common.KeyPlacement
+			if err := json.Unmarshal(body, &placement); err != nil {
+				log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+				continue
+			}
+			fmt.Printf("Key: %s\nOwners: %s\nLive: %s\nStale: %s\nMissing: %s\n", placement.Key,
+				strings.Join(placement.Owners, ", "), strings.Join(placement.Live, ", "),
+				strings.Join(placement.Stale, ", "), strings.Join(placement.Missing, ", "))
+			return
+		}
+		fmt.Println("No storage node could answer the request")
+		return
+	}
+
+	var reports []common.OwnershipReport
+	var silent []string
+	for _, ip := range storeIps {
+		body, err := doRequestWithRetry(fmt.Sprintf("http://%s:10001/admin/ownership?%s", ip, values.Encode()), 3)
+		if err != nil {
+			log.Printf("Error querying %s: %s", ip, err.Error())
+			silent = append(silent, ip)
+			continue
+		}
+
+		var report common.OwnershipReport
+		if err := json.Unmarshal(body, &report); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			silent = append(silent, ip)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	if len(reports) == 0 {
+		fmt.Println("No storage node could answer the request")
+		return
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Node < reports[j].Node
+	})
+
+	fmt.Println("Node\tZone\tRanges\tOwned\tReplica\tMisplaced\tUnder-replicated")
+	owned := 0
+	var under []common.KeyPlacement
+	seen := make(map[string]bool)
+	for _, report := range reports {
+		fmt.Printf("%s\t%s\t%d\t%d\t%d\t%d\t%d\n", report.Node, report.Zone, len(report.Ranges),
+			report.Owned, report.Replica, report.Misplaced, len(report.UnderReplicated))
+		owned += report.Owned
+
+		// A key missing from its primary may be reported by the primary and a
+		// replica when they can't reach each other
+		for _, placement := range report.UnderReplicated {
+			if !seen[placement.Key] {
+				seen[placement.Key] = true
+				under = append(under, placement)
+			}
+		}
+	}
+
+	target := reports[0].Replicas
+	lost := 0
+	fmt.Printf("\n%d keys, %d with fewer than %d live replicas\n", owned, len(under), target)
+	for _, placement := range under {
+		if len(placement.Live) == 0 {
+			lost++
+		}
+		fmt.Printf("%s\t%d/%d\tlive: %s\tmissing: %s\n", placement.Key, len(placement.Live), target,
+			strings.Join(placement.Live, ", "), strings.Join(placement.Missing, ", "))
+	}
+
+	if len(silent) > 0 {
+		fmt.Printf("\nThe keys owned by %s are not included, they didn't answer\n", strings.Join(silent, ", "))
+	}
+
+	if without := values.Get("without"); without != "" {
+		switch {
+		case lost > 0:
+			fmt.Printf("\nTaking %s down would leave %d keys without any copy\n", without, lost)
+		case len(silent) > 0:
+			fmt.Printf("\nCan't tell if %s can be taken down, the keys of the nodes that didn't answer were not checked\n", without)
+		default:
+			fmt.Printf("\n%s can be taken down, every key keeps at least one copy\n", without)
+		}
+	}
+}
+
+func search(params []string) {
+	if len(params) == 0 {
+		fmt.Println("Usage: cli search <keywords>")
+		return
+	}
+
+	q := url.QueryEscape(strings.Join(params, " "))
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	for _, ip := range storeIps {
+		url := fmt.Sprintf("http://%s:10001/search?q=%s", ip, q)
+		body, err := doRequestWithRetry(url, 3)
+		if err != nil {
+			log.Printf("Error searching on %s: %s", ip, err.Error())
+			continue
+		}
+
+		var results []common.SearchResult
+		if err := json.Unmarshal(body, &results); err != nil {
+			log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+			continue
+		}
+
+		fmt.Println("Score\tName\tPrice\tURL")
+		for _, result := range results {
+			if result.Product == nil {
+				fmt.Printf("%.3f\t%s\t-\t-\n", result.Score, result.Key)
+				continue
+			}
+			fmt.Printf("%.3f\t%s\t%.2f\t%s\n", result.Score, result.Key, result.Product.Price, result.Product.URL)
+		}
+		return
+	}
+
+	fmt.Println("No storage node could answer the search")
+}
+
+func history(params []string) {
+	if len(params) == 0 {
+		fmt.Println("Usage: cli history <product name>")
+		return
+	}
+
+	key := url.QueryEscape(strings.Join(params, " "))
+
+	storeIps, err := common.NetDiscover("10000", "STORAGE", false, true)
+	if err != nil {
+		log.Fatalf("Error while discovering storage nodes %s", err.Error())
+	}
+
+	// Every replica may have missed some observations, so merge all of them
+	pointMap := make(map[int64]common.PricePoint)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, ip := range storeIps {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			url := fmt.Sprintf("http://%s:10001/history?key=%s", ip, key)
+			body, err := doRequestWithRetry(url, 3)
+			if err != nil {
+				log.Printf("Error fetching from %s: %s", ip, err.Error())
+				return
+			}
+
+			var points []common.PricePoint
+			if err := json.Unmarshal(body, &points); err != nil {
+				log.Printf("Error unmarshalling response from %s: %s", ip, err.Error())
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, point := range points {
+				pointMap[point.Time.UnixNano()] = point
+			}
+		}(ip)
+	}
+
+	wg.Wait()
+
+	if len(pointMap) == 0 {
+		fmt.Printf("No history found for %s\n", strings.Join(params, " "))
+		return
+	}
+
+	points := make([]common.PricePoint, 0, len(pointMap))
+	for _, point := range pointMap {
+		points = append(points, point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+
+	fmt.Println("Time\tPrice\tRating\tAvailable")
+	for _, point := range points {
+		fmt.Printf("%s\t%.2f\t%s\t%t\n", point.Time.Format(time.RFC3339), point.Price, point.Rating, point.Available)
 	}
 }
 
@@ -1,13 +1,59 @@
 package common
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the Product layout written by this code. Stored
+// records with an older version are upgraded by UpgradeProduct when read.
+const SchemaVersion = 2
+
+type Availability string
+
+const (
+	InStock             Availability = "in_stock"
+	OutOfStock          Availability = "out_of_stock"
+	UnknownAvailability Availability = "unknown"
+)
+
 type Product struct {
-	Name        string  `json:"name"`
-	Price       float32 `json:"price"`
-	URL         string  `json:"url"`
-	Description string  `json:"description"`
-	Rating      string  `json:"rating"`
-	NodeAuthor  string  `json:"node_author"`
-	Replicated  bool    `json:"replicated"`
+	// Records written before the schema was versioned read as 0
+	SchemaVersion int    `json:"schema_version"`
+	Name          string `json:"name"`
+	// Store the product was scraped from, see SourceFromURL
+	Source string `json:"source"`
+	// ASIN for Amazon, item number for Newegg
+	SKU string `json:"sku,omitempty"`
+	// Manufacturer identifiers, used to match the listings of an item across stores
+	UPC          string       `json:"upc,omitempty"`
+	MPN          string       `json:"mpn,omitempty"`
+	Price        float64      `json:"price"`
+	Currency     string       `json:"currency"`
+	Availability Availability `json:"availability"`
+	URL          string       `json:"url"`
+	Images       []string     `json:"images,omitempty"`
+	Description  string       `json:"description"`
+	Category     string       `json:"category,omitempty"`
+	// Rating is the text as scraped, RatingValue the same rating out of 5
+	Rating      string    `json:"rating"`
+	RatingValue float64   `json:"rating_value"`
+	ReviewCount int       `json:"review_count"`
+	ScrapedAt   time.Time `json:"scraped_at"`
+	NodeAuthor  string    `json:"node_author"`
+	Replicated  bool      `json:"replicated"`
+	Version     Version   `json:"version"`
+	// Deleted products are kept as tombstones so replicas don't bring them back,
+	// the version tells when it was deleted
+	Deleted bool `json:"deleted,omitempty"`
+	// Hash of the record, see ProductChecksum
+	Checksum string `json:"checksum,omitempty"`
 }
 
 type URLMessage struct {
@@ -24,3 +70,220 @@ const (
 	AmazonRoot
 	Dummy
 )
+
+// SourceFromURL returns the store a product was scraped from based on its URL
+func SourceFromURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	switch {
+	case strings.Contains(host, "amazon."):
+		return "amazon"
+	case strings.Contains(host, "newegg."):
+		return "newegg"
+	}
+
+	return host
+}
+
+// ProductChecksum hashes the content of a product. The Replicated flag is left out
+// since it is the only field that differs between the copies of a product.
+func ProductChecksum(product Product) string {
+	product.Checksum = ""
+	product.Replicated = false
+
+	data, _ := json.Marshal(product)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// productV1 is the layout records had before the schema was versioned, their
+// checksum was computed over it
+type productV1 struct {
+	Name        string  `json:"name"`
+	Price       float32 `json:"price"`
+	URL         string  `json:"url"`
+	Description string  `json:"description"`
+	Rating      string  `json:"rating"`
+	NodeAuthor  string  `json:"node_author"`
+	Replicated  bool    `json:"replicated"`
+	Version     Version `json:"version"`
+	Deleted     bool    `json:"deleted,omitempty"`
+	Checksum    string  `json:"checksum,omitempty"`
+}
+
+// checksumV1 hashes a record read with an older schema the way it was hashed when
+// it was written
+func checksumV1(product Product) string {
+	data, _ := json.Marshal(productV1{
+		Name:        product.Name,
+		Price:       float32(product.Price),
+		URL:         product.URL,
+		Description: product.Description,
+		Rating:      product.Rating,
+		NodeAuthor:  product.NodeAuthor,
+		Version:     product.Version,
+		Deleted:     product.Deleted,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum tells if the product matches its checksum, products stored
+// before checksums existed have none and are accepted. A record with an older
+// schema is checked against the layout it was written with.
+func VerifyChecksum(product Product) bool {
+	if product.Checksum == "" {
+		return true
+	}
+	if product.SchemaVersion < SchemaVersion {
+		return product.Checksum == checksumV1(product)
+	}
+	return product.Checksum == ProductChecksum(product)
+}
+
+// Keywords that identify the category of a product by its name, the first match wins
+var categoryKeywords = []struct {
+	category string
+	keywords []string
+}{
+	{"gpu", []string{"rtx", "gtx", "geforce", "radeon", "graphics card", "video card"}},
+	{"cpu", []string{"ryzen", "core i3", "core i5", "core i7", "core i9", "processor", "cpu"}},
+	{"motherboard", []string{"motherboard", "mainboard"}},
+	{"memory", []string{"ddr4", "ddr5", "ram", "memory"}},
+	{"storage", []string{"ssd", "nvme", "hard drive", "hdd"}},
+	{"monitor", []string{"monitor", "display"}},
+	{"laptop", []string{"laptop", "notebook"}},
+	{"power supply", []string{"power supply", "psu"}},
+	{"keyboard", []string{"keyboard"}},
+	{"mouse", []string{"mouse"}},
+}
+
+// CategoryOf returns the category of the product, guessing it from the name when
+// the scrapper didn't set one
+func CategoryOf(product Product) string {
+	if product.Category != "" {
+		return strings.ToLower(product.Category)
+	}
+
+	words := " " + strings.Join(strings.FieldsFunc(strings.ToLower(product.Name), func(r rune) bool {
+		return !('a' <= r && r <= 'z') && !('0' <= r && r <= '9')
+	}), " ") + " "
+
+	for _, entry := range categoryKeywords {
+		for _, keyword := range entry.keywords {
+			if strings.Contains(words, " "+keyword+" ") {
+				return entry.category
+			}
+		}
+	}
+
+	return "other"
+}
+
+var ratingRegex = regexp.MustCompile(`[0-9]+(\.[0-9]+)?`)
+
+// ParseRating extracts the numeric rating out of strings like "4.5 out of 5 eggs"
+func ParseRating(rating string) float64 {
+	match := ratingRegex.FindString(rating)
+	if match == "" {
+		return 0
+	}
+
+	value, _ := strconv.ParseFloat(match, 64)
+	return value
+}
+
+var (
+	asinRegex   = regexp.MustCompile(`/(?:dp|gp/product)/([A-Z0-9]{10})`)
+	neweggRegex = regexp.MustCompile(`/p/([A-Za-z0-9-]+)`)
+)
+
+// SKUFromURL returns the identifier the store gives to the product in its URL
+func SKUFromURL(rawURL string) string {
+	var match []string
+	switch SourceFromURL(rawURL) {
+	case "amazon":
+		match = asinRegex.FindStringSubmatch(rawURL)
+	case "newegg":
+		match = neweggRegex.FindStringSubmatch(rawURL)
+	}
+
+	if len(match) < 2 {
+		return ""
+	}
+	return match[1]
+}
+
+// NormalizeProduct fills the fields that can be derived from the rest of the
+// product and weren't set by the scrapper
+func NormalizeProduct(product Product) Product {
+	product.SchemaVersion = SchemaVersion
+	if product.Source == "" {
+		product.Source = SourceFromURL(product.URL)
+	}
+	if product.SKU == "" {
+		product.SKU = SKUFromURL(product.URL)
+	}
+	if product.Currency == "" {
+		product.Currency = "USD"
+	}
+	if product.RatingValue == 0 {
+		product.RatingValue = ParseRating(product.Rating)
+	}
+	if product.Availability == "" {
+		product.Availability = UnknownAvailability
+	}
+	if !product.Deleted {
+		product.Category = CategoryOf(product)
+	}
+	return product
+}
+
+// migrations upgrade a record from the version they are keyed by to the next one
+var migrations = map[int]func(product *Product){
+	// Version 1 had no source, currency, availability nor numeric rating. It
+	// was considered available when the scrapper found a price.
+	1: func(product *Product) {
+		if product.Deleted {
+			return
+		}
+		if product.Price > 0 {
+			product.Availability = InStock
+		} else {
+			product.Availability = OutOfStock
+		}
+		if product.ScrapedAt.IsZero() && !product.Version.IsZero() {
+			product.ScrapedAt = time.UnixMilli(product.Version.WallTime).UTC()
+		}
+	},
+}
+
+// UpgradeProduct migrates a record written with an older schema to the current
+// one. The checksum is computed again since the layout it covered changed.
+func UpgradeProduct(product Product) Product {
+	if product.SchemaVersion >= SchemaVersion {
+		return product
+	}
+
+	if product.SchemaVersion == 0 {
+		product.SchemaVersion = 1
+	}
+	for product.SchemaVersion < SchemaVersion {
+		if migrate, ok := migrations[product.SchemaVersion]; ok {
+			migrate(&product)
+		}
+		product.SchemaVersion++
+	}
+
+	if !product.Deleted {
+		product = NormalizeProduct(product)
+	}
+	if product.Checksum != "" {
+		product.Checksum = ProductChecksum(product)
+	}
+	return product
+}
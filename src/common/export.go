@@ -0,0 +1,276 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats products can be exported to
+const (
+	ExportCSV    = "csv"
+	ExportTSV    = "tsv"
+	ExportNDJSON = "ndjson"
+	ExportJSON   = "json"
+)
+
+// ExportColumns are the fields of a product that can be exported, in the order
+// they are exported by default
+var ExportColumns = []string{
+	"name", "source", "sku", "upc", "mpn", "category", "price", "currency", "availability",
+	"rating", "rating_value", "review_count", "url", "images", "description", "scraped_at",
+}
+
+func exportValue(product Product, column string) interface{} {
+	switch column {
+	case "name":
+		return product.Name
+	case "source":
+		return product.Source
+	case "sku":
+		return product.SKU
+	case "upc":
+		return product.UPC
+	case "mpn":
+		return product.MPN
+	case "category":
+		return CategoryOf(product)
+	case "price":
+		return product.Price
+	case "currency":
+		return product.Currency
+	case "availability":
+		return string(product.Availability)
+	case "rating":
+		return product.Rating
+	case "rating_value":
+		return product.RatingValue
+	case "review_count":
+		return product.ReviewCount
+	case "url":
+		return product.URL
+	case "images":
+		if product.Images == nil {
+			return []string{}
+		}
+		return product.Images
+	case "description":
+		return product.Description
+	case "scraped_at":
+		if product.ScrapedAt.IsZero() {
+			return ""
+		}
+		return product.ScrapedAt.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// ParseExportColumns reads a comma separated list of columns, every column when
+// it is empty
+func ParseExportColumns(raw string) ([]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return append([]string(nil), ExportColumns...), nil
+	}
+
+	var columns []string
+	for _, column := range strings.Split(raw, ",") {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if exportValue(Product{}, column) == nil {
+			return nil, fmt.Errorf("unknown column: %s", column)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// formatValue is how a value looks in the text formats, images are separated by
+// spaces since URLs can't contain them
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, " ")
+	}
+	return fmt.Sprint(value)
+}
+
+// EscapeTSV escapes the characters that would break a tab separated line
+func EscapeTSV(field string) string {
+	return strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace(field)
+}
+
+// ValidExportFormat tells if products can be exported to the format
+func ValidExportFormat(format string) bool {
+	switch format {
+	case ExportCSV, ExportTSV, ExportNDJSON, ExportJSON:
+		return true
+	}
+	return false
+}
+
+// ExportContentType is the media type of the format
+func ExportContentType(format string) string {
+	switch format {
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportTSV:
+		return "text/tab-separated-values; charset=utf-8"
+	case ExportNDJSON:
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// Exporter writes products one at a time, Close finishes the output
+type Exporter interface {
+	Write(product Product) error
+	Close() error
+}
+
+// NewExporter returns an exporter of the columns in the format. The text formats
+// start with a header line.
+func NewExporter(w io.Writer, format string, columns []string) (Exporter, error) {
+	switch format {
+	case ExportCSV:
+		exporter := &csvExporter{writer: csv.NewWriter(w), columns: columns}
+		return exporter, exporter.writer.Write(columns)
+	case ExportTSV:
+		exporter := &tsvExporter{writer: bufio.NewWriter(w), columns: columns}
+		return exporter, exporter.writeLine(columns)
+	case ExportNDJSON:
+		return &jsonExporter{writer: bufio.NewWriter(w), columns: columns, lines: true}, nil
+	case ExportJSON:
+		return &jsonExporter{writer: bufio.NewWriter(w), columns: columns}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// csvExporter quotes the fields with commas, quotes or line breaks as RFC 4180 says
+type csvExporter struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func (e *csvExporter) Write(product Product) error {
+	record := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		record[i] = formatValue(exportValue(product, column))
+	}
+	return e.writer.Write(record)
+}
+
+func (e *csvExporter) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type tsvExporter struct {
+	writer  *bufio.Writer
+	columns []string
+}
+
+func (e *tsvExporter) writeLine(fields []string) error {
+	escaped := make([]string, len(fields))
+	for i, field := range fields {
+		escaped[i] = EscapeTSV(field)
+	}
+	_, err := e.writer.WriteString(strings.Join(escaped, "\t") + "\n")
+	return err
+}
+
+func (e *tsvExporter) Write(product Product) error {
+	fields := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		fields[i] = formatValue(exportValue(product, column))
+	}
+	return e.writeLine(fields)
+}
+
+func (e *tsvExporter) Close() error {
+	return e.writer.Flush()
+}
+
+// jsonExporter writes one object per line, or a pretty printed array. The
+// objects keep the order of the columns.
+type jsonExporter struct {
+	writer  *bufio.Writer
+	columns []string
+	lines   bool
+	count   int
+}
+
+func (e *jsonExporter) object(product Product, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, column := range e.columns {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		if indent != "" {
+			buf.WriteString("\n" + indent + "  ")
+		}
+
+		key, _ := json.Marshal(column)
+		value, err := json.Marshal(exportValue(product, column))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		if indent != "" {
+			buf.WriteString(" ")
+		}
+		buf.Write(value)
+	}
+	if indent != "" && len(e.columns) > 0 {
+		buf.WriteString("\n" + indent)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+func (e *jsonExporter) Write(product Product) error {
+	if e.lines {
+		data, err := e.object(product, "")
+		if err != nil {
+			return err
+		}
+		e.writer.Write(data)
+		return e.writer.WriteByte('\n')
+	}
+
+	separator := ",\n  "
+	if e.count == 0 {
+		separator = "[\n  "
+	}
+	e.count++
+
+	data, err := e.object(product, "  ")
+	if err != nil {
+		return err
+	}
+	e.writer.WriteString(separator)
+	_, err = e.writer.Write(data)
+	return err
+}
+
+func (e *jsonExporter) Close() error {
+	if !e.lines {
+		if e.count == 0 {
+			e.writer.WriteString("[")
+		} else {
+			e.writer.WriteString("\n")
+		}
+		e.writer.WriteString("]\n")
+	}
+	return e.writer.Flush()
+}
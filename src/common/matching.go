@@ -0,0 +1,254 @@
+package common
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// Listings whose titles are at least this similar are considered the same item
+// when they have no identifier in common
+const TitleMatchThreshold = 0.6
+
+// Offer is the listing of an item in one store
+type Offer struct {
+	Key          string       `json:"key"`
+	Source       string       `json:"source"`
+	SKU          string       `json:"sku,omitempty"`
+	Price        float64      `json:"price"`
+	Currency     string       `json:"currency"`
+	Availability Availability `json:"availability"`
+	RatingValue  float64      `json:"rating_value"`
+	URL          string       `json:"url"`
+	// How similar the listing is to the first offer of the group, 1 when they
+	// share an identifier
+	Score float64 `json:"score"`
+}
+
+// OfferGroup is an item with its listings across stores, cheapest first
+type OfferGroup struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Category    string  `json:"category"`
+	UPC         string  `json:"upc,omitempty"`
+	MPN         string  `json:"mpn,omitempty"`
+	LowestPrice float64 `json:"lowest_price"`
+	Offers      []Offer `json:"offers"`
+}
+
+// Words that say nothing about which item a listing is
+var titleStopwords = map[string]bool{
+	"the": true, "a": true, "an": true, "and": true, "with": true, "for": true,
+	"of": true, "in": true, "new": true, "edition": true, "version": true,
+}
+
+// TitleTokens normalizes a title into its set of words
+func TitleTokens(title string) map[string]bool {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !('a' <= r && r <= 'z') && !('0' <= r && r <= '9')
+	})
+
+	tokens := make(map[string]bool)
+	for _, word := range words {
+		if !titleStopwords[word] {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
+
+func hasDigit(word string) bool {
+	return strings.ContainsAny(word, "0123456789")
+}
+
+// TitleSimilarity scores two titles between 0 and 1 with the Jaccard index of
+// their words. Words with digits are usually model numbers, titles that disagree
+// on them are different items however many other words they share.
+func TitleSimilarity(a string, b string) float64 {
+	tokensA, tokensB := TitleTokens(a), TitleTokens(b)
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for token := range tokensA {
+		if tokensB[token] {
+			shared++
+		} else if hasDigit(token) {
+			return 0
+		}
+	}
+	for token := range tokensB {
+		if !tokensA[token] && hasDigit(token) {
+			return 0
+		}
+	}
+
+	return float64(shared) / float64(len(tokensA)+len(tokensB)-shared)
+}
+
+func normalizeIdentifier(id string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(id))
+}
+
+// MatchScore tells how likely two listings are the same item. Identifiers decide
+// when both listings have them, the title similarity is used otherwise.
+func MatchScore(a Product, b Product) float64 {
+	if a.UPC != "" && b.UPC != "" {
+		if normalizeIdentifier(a.UPC) == normalizeIdentifier(b.UPC) {
+			return 1
+		}
+		return 0
+	}
+	if a.MPN != "" && b.MPN != "" && normalizeIdentifier(a.MPN) == normalizeIdentifier(b.MPN) {
+		return 1
+	}
+	// The same ASIN or item number is the same listing in the same store
+	if a.SKU != "" && a.SKU == b.SKU && a.Source == b.Source {
+		return 1
+	}
+
+	if CategoryOf(a) != CategoryOf(b) {
+		return 0
+	}
+	return TitleSimilarity(a.Name, b.Name)
+}
+
+func newOffer(product Product, score float64) Offer {
+	return Offer{
+		Key:          product.Name,
+		Source:       product.Source,
+		SKU:          product.SKU,
+		Price:        product.Price,
+		Currency:     product.Currency,
+		Availability: product.Availability,
+		RatingValue:  product.RatingValue,
+		URL:          product.URL,
+		Score:        score,
+	}
+}
+
+// GroupOffers groups the listings of the same item. Every product joins the first
+// group whose first listing matches it, products carrying identifiers go first so
+// they seed the groups.
+func GroupOffers(products []Product) []OfferGroup {
+	sorted := make([]Product, 0, len(products))
+	for _, product := range products {
+		if !product.Deleted {
+			sorted = append(sorted, product)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		idI := sorted[i].UPC != "" || sorted[i].MPN != ""
+		idJ := sorted[j].UPC != "" || sorted[j].MPN != ""
+		if idI != idJ {
+			return idI
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	var seeds []Product
+	var groups []OfferGroup
+	for _, product := range sorted {
+		best, bestScore := -1, 0.0
+		for i, seed := range seeds {
+			if score := MatchScore(seed, product); score >= TitleMatchThreshold && score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+
+		if best < 0 {
+			seeds = append(seeds, product)
+			groups = append(groups, OfferGroup{
+				Title:    product.Name,
+				Category: CategoryOf(product),
+				UPC:      product.UPC,
+				MPN:      product.MPN,
+				Offers:   []Offer{newOffer(product, 1)},
+			})
+			continue
+		}
+
+		group := &groups[best]
+		group.Offers = append(group.Offers, newOffer(product, bestScore))
+		if group.UPC == "" {
+			group.UPC = product.UPC
+		}
+		if group.MPN == "" {
+			group.MPN = product.MPN
+		}
+	}
+
+	for i := range groups {
+		group := &groups[i]
+		sort.SliceStable(group.Offers, func(a, b int) bool {
+			return offerLess(group.Offers[a], group.Offers[b])
+		})
+		group.LowestPrice = group.Offers[0].Price
+		group.ID = groupID(*group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Title < groups[j].Title
+	})
+	return groups
+}
+
+// offerLess puts the offers with a price first, cheapest to most expensive
+func offerLess(a Offer, b Offer) bool {
+	if (a.Price > 0) != (b.Price > 0) {
+		return a.Price > 0
+	}
+	return a.Price < b.Price
+}
+
+// groupID identifies the group by its identifiers, or by the keys of its offers
+// when it has none, so the same group gets the same id on every node
+func groupID(group OfferGroup) string {
+	var id string
+	switch {
+	case group.UPC != "":
+		id = "upc:" + normalizeIdentifier(group.UPC)
+	case group.MPN != "":
+		id = "mpn:" + normalizeIdentifier(group.MPN)
+	default:
+		keys := make([]string, 0, len(group.Offers))
+		for _, offer := range group.Offers {
+			keys = append(keys, offer.Key)
+		}
+		sort.Strings(keys)
+		id = "keys:" + strings.Join(keys, "|")
+	}
+
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// OffersFor returns the group of the product with the candidates that are the
+// same item
+func OffersFor(product Product, candidates []Product) OfferGroup {
+	group := OfferGroup{
+		Title:    product.Name,
+		Category: CategoryOf(product),
+		UPC:      product.UPC,
+		MPN:      product.MPN,
+		Offers:   []Offer{newOffer(product, 1)},
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Name == product.Name || candidate.Deleted {
+			continue
+		}
+		if score := MatchScore(product, candidate); score >= TitleMatchThreshold {
+			group.Offers = append(group.Offers, newOffer(candidate, score))
+		}
+	}
+
+	sort.SliceStable(group.Offers, func(a, b int) bool {
+		return offerLess(group.Offers[a], group.Offers[b])
+	})
+	group.LowestPrice = group.Offers[0].Price
+	group.ID = groupID(group)
+	return group
+}
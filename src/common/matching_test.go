@@ -0,0 +1,46 @@
+package common
+
+import "testing"
+
+func TestGroupOffers(t *testing.T) {
+	products := []Product{
+		{Name: "amazon-4060", Source: "amazon", Price: 309.99, MPN: "RTX 4060 VENTUS 2X BLACK 8G OC"},
+		{Name: "newegg-4060", Source: "newegg", Price: 299.99, MPN: "RTX4060VENTUS2XBLACK8GOC"},
+		{Name: "MSI GeForce RTX 4070 Ventus 2X 12G", Source: "newegg", Price: 549.99},
+		{Name: "MSI GeForce RTX 4070 Ventus 2X 12G OC", Source: "amazon", Price: 569.99},
+		{Name: "MSI GeForce RTX 4070 Ti Ventus 3X 12G", Source: "amazon", Price: 749.99},
+	}
+
+	groups := GroupOffers(products)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %+v", groups)
+	}
+
+	for _, group := range groups {
+		switch group.Offers[0].Key {
+		case "newegg-4060":
+			if len(group.Offers) != 2 || group.LowestPrice != 299.99 {
+				t.Fatalf("expected the listings with the same MPN together, got %+v", group)
+			}
+		case "MSI GeForce RTX 4070 Ventus 2X 12G":
+			if len(group.Offers) != 2 || group.Offers[1].Source != "amazon" {
+				t.Fatalf("expected the listings with similar titles together, got %+v", group)
+			}
+		case "MSI GeForce RTX 4070 Ti Ventus 3X 12G":
+			if len(group.Offers) != 1 {
+				t.Fatalf("expected a different model on its own, got %+v", group)
+			}
+		default:
+			t.Fatalf("unexpected group %+v", group)
+		}
+	}
+}
+
+func TestTitleSimilarityModelNumbers(t *testing.T) {
+	if score := TitleSimilarity("Samsung 990 Pro 2TB NVMe SSD", "Samsung 990 PRO 2TB SSD"); score < TitleMatchThreshold {
+		t.Fatalf("expected similar titles to match, got %v", score)
+	}
+	if score := TitleSimilarity("Samsung 990 Pro 2TB NVMe SSD", "Samsung 990 Pro 1TB NVMe SSD"); score != 0 {
+		t.Fatalf("expected different capacities not to match, got %v", score)
+	}
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrProductNotFound = errors.New("product not found")
+
+var storageHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// GetProduct fetches a single product from the storage cluster. The address is the
+// http address of any storage node, it routes the request to the owners of the key.
+func GetProduct(address string, key string) (Product, error) {
+	var product Product
+
+	endpoint := fmt.Sprintf("http://%s/product?key=%s", address, url.QueryEscape(key))
+	resp, err := storageHttpClient.Get(endpoint)
+	if err != nil {
+		return product, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return product, ErrProductNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return product, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		return product, fmt.Errorf("failed to decode product: %v", err)
+	}
+
+	return product, nil
+}
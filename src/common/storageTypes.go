@@ -0,0 +1,105 @@
+package common
+
+import "time"
+
+// The types below travel between the storage nodes and their clients, they are
+// declared once here so both sides agree on them.
+
+// PricePoint is a single observation of a product taken every time it is scraped
+type PricePoint struct {
+	Time      time.Time `json:"time"`
+	Price     float64   `json:"price"`
+	Rating    string    `json:"rating"`
+	Available bool      `json:"available"`
+}
+
+// Change is an entry of the change log of a node. Every write of a product to this
+// node gets the next sequence number, replicated writes included.
+type Change struct {
+	Seq     uint64    `json:"seq"`
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	Version Version   `json:"version"`
+	Time    time.Time `json:"time"`
+	Product *Product  `json:"product,omitempty"`
+}
+
+// Operations of a Change
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// WatchRule alerts when a product drops to the threshold or below. It watches a
+// single key or every product matching the filters of a /query.
+type WatchRule struct {
+	ID        string  `json:"id"`
+	Key       string  `json:"key,omitempty"`
+	Query     string  `json:"query,omitempty"`
+	Threshold float64 `json:"threshold"`
+	// Where the alerts are sent, see alertSinks in storage
+	Sink    string    `json:"sink"`
+	Target  string    `json:"target,omitempty"`
+	Created time.Time `json:"created"`
+	Version Version   `json:"version"`
+	// Removed rules are kept like product tombstones so replicas don't bring
+	// them back
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// ReplicationConfig is the cluster-wide replication setting. N is the number of
+// hosts holding every product, a write succeeds after W of them acknowledge it
+// and a read waits for R of them. The newest version wins across the cluster.
+type ReplicationConfig struct {
+	Replicas    int     `json:"replicas"`
+	ReadQuorum  int     `json:"read_quorum"`
+	WriteQuorum int     `json:"write_quorum"`
+	Version     Version `json:"version"`
+}
+
+type SearchResult struct {
+	Key     string   `json:"key"`
+	Score   float64  `json:"score"`
+	Product *Product `json:"product,omitempty"`
+}
+
+// OwnedRange is a range of the ring a node is the primary owner of, the keys
+// hashing after Start up to End
+type OwnedRange struct {
+	Vnode string `json:"vnode"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// KeyPlacement tells where the replicas of a key are
+type KeyPlacement struct {
+	Key    string   `json:"key"`
+	Owners []string `json:"owners"`
+	// Owners holding a copy of the key
+	Live []string `json:"live"`
+	// Live owners whose copy differs from the primary, anti-entropy will sync them
+	Stale []string `json:"stale,omitempty"`
+	// Owners without a copy or that didn't answer
+	Missing []string `json:"missing,omitempty"`
+}
+
+// OwnershipReport is what a node owns and how well its keys are replicated. A key
+// is reported by its primary owner, or by its first replica holding a copy when
+// the primary doesn't have one, so the reports of all the nodes cover the cluster.
+type OwnershipReport struct {
+	Node     string       `json:"node"`
+	Zone     string       `json:"zone,omitempty"`
+	Replicas int          `json:"replicas"`
+	Ranges   []OwnedRange `json:"ranges"`
+	// Keys the node is the primary owner of, holds as a replica, and holds
+	// without being an owner anymore until they are handed off
+	Owned     int `json:"owned"`
+	Replica   int `json:"replica"`
+	Misplaced int `json:"misplaced"`
+	// The host the report pretends is down, to check it can be taken down
+	Without         string         `json:"without,omitempty"`
+	Unreachable     []string       `json:"unreachable,omitempty"`
+	UnderReplicated []KeyPlacement `json:"under_replicated"`
+	Keys            []KeyPlacement `json:"keys,omitempty"`
+}
@@ -0,0 +1,39 @@
+package common
+
+import "fmt"
+
+// Version is a hybrid logical clock timestamp. The wall time keeps versions close
+// to real time, the logical counter orders events within the same millisecond and
+// the node breaks ties so every replica picks the same winner.
+type Version struct {
+	WallTime int64  `json:"wall_time"`
+	Logical  uint32 `json:"logical"`
+	Node     string `json:"node"`
+}
+
+// Compare returns -1, 0 or 1 if v is older, equal or newer than other
+func (v Version) Compare(other Version) int {
+	switch {
+	case v.WallTime < other.WallTime:
+		return -1
+	case v.WallTime > other.WallTime:
+		return 1
+	case v.Logical < other.Logical:
+		return -1
+	case v.Logical > other.Logical:
+		return 1
+	case v.Node < other.Node:
+		return -1
+	case v.Node > other.Node:
+		return 1
+	}
+	return 0
+}
+
+func (v Version) IsZero() bool {
+	return v.WallTime == 0 && v.Logical == 0 && v.Node == ""
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d@%s", v.WallTime, v.Logical, v.Node)
+}
@@ -88,8 +88,33 @@ func (q *Queue) RequeueInvisibleMessages(timeout time.Duration) {
 
 var (
 	q = NewQueue()
+
+	// Other services publish on their own topics so the scrappers, which read
+	// the default queue, never see their messages
+	topics      = make(map[string]*Queue)
+	topicsMutex sync.Mutex
 )
 
+// queueFor returns the queue of the topic given in the request, the default queue
+// when there is none
+func queueFor(r *http.Request) *Queue {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		return q
+	}
+
+	topicsMutex.Lock()
+	defer topicsMutex.Unlock()
+
+	topicQueue, ok := topics[topic]
+	if !ok {
+		topicQueue = NewQueue()
+		topicQueue.addr = q.addr
+		topics[topic] = topicQueue
+	}
+	return topicQueue
+}
+
 func putHandler(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Message string `json:"message"`
@@ -98,12 +123,12 @@ func putHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	q.Put(body.Message)
+	queueFor(r).Put(body.Message)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func popHandler(w http.ResponseWriter, r *http.Request) {
-	message, ok := q.Pop()
+	message, ok := queueFor(r).Pop()
 	if !ok {
 		http.Error(w, "Queue is empty", http.StatusNoContent)
 		return
@@ -119,7 +144,7 @@ func ackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	q.Ack(body.ID)
+	queueFor(r).Ack(body.ID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -138,6 +163,12 @@ func requeueInvisibleMessages() {
 	for {
 		time.Sleep(10 * time.Second)
 		q.RequeueInvisibleMessages(30 * time.Second)
+
+		topicsMutex.Lock()
+		for _, topicQueue := range topics {
+			topicQueue.RequeueInvisibleMessages(30 * time.Second)
+		}
+		topicsMutex.Unlock()
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	common "commons"
 	"encoding/json"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log"
@@ -46,7 +47,7 @@ func main() {
 
 	go func() {
 		for d := range msgs {
-			var product Product
+			var product common.Product
 			err := json.Unmarshal(d.Body, &product)
 			if err != nil {
 				log.Fatal(err)
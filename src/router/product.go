@@ -1,9 +0,0 @@
-package main
-
-type Product struct {
-	Name        string
-	Price       float64
-	URL         string
-	Description string
-	Rating      string
-}
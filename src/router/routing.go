@@ -1,6 +1,7 @@
 package main
 
 import (
+	common "commons"
 	"context"
 	"encoding/json"
 	"github.com/go-redis/redis/v8"
@@ -24,7 +25,7 @@ func init() {
 	// Add as many nodes as you have in your system.
 }
 
-func Send(product Product, addr string) {
+func Send(product common.Product, addr string) {
 	jsonProduct, err := json.Marshal(product)
 	if err != nil {
 		log.Printf("Failed to marshal product: %s", err)
@@ -48,7 +49,7 @@ func Send(product Product, addr string) {
 	log.Printf("Product %s inserted correctly in node %s", product.Name, addr)
 }
 
-func Route(product Product) {
+func Route(product common.Product) {
 	node := consistentHash.GetNode(product.Name)
 
 	Send(product, node.ip)
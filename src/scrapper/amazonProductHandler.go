@@ -6,6 +6,7 @@ import (
 	"github.com/gocolly/colly/v2"
 	"log"
 	"strconv"
+	"strings"
 )
 
 func (s *ScrapperNode) AmazonProductHandler(url string) common.Product {
@@ -22,17 +23,42 @@ func (s *ScrapperNode) AmazonProductHandler(url string) common.Product {
 	})
 
 	c.OnHTML(".a-section .a-price span .a-price-whole", func(e *colly.HTMLElement) {
-		t, err := strconv.ParseFloat(e.Text, 32)
+		t, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSuffix(e.Text, "."), ",", ""), 64)
 		if err != nil {
 			log.Println(err)
 		}
-		product.Price = float32(t)
+		product.Price = t
 	})
 
 	c.OnHTML("#averageCustomerReviews .a-icon-star a-icon-alt", func(e *colly.HTMLElement) {
 		product.Rating = e.Text
 	})
 
+	c.OnHTML("#acrCustomerReviewText", func(e *colly.HTMLElement) {
+		product.ReviewCount = parseCount(e.Text)
+	})
+
+	c.OnHTML("#availability span", func(e *colly.HTMLElement) {
+		product.Availability = parseAvailability(e.Text)
+	})
+
+	// The technical details table holds the identifiers of the manufacturer
+	c.OnHTML("#productDetails_techSpec_section_1 tr, #productDetails_detailBullets_sections1 tr", func(e *colly.HTMLElement) {
+		value := strings.Trim(strings.TrimSpace(e.ChildText("td")), "\u200e")
+		switch strings.TrimSpace(e.ChildText("th")) {
+		case "UPC":
+			product.UPC = value
+		case "Item model number", "Manufacturer Part Number":
+			if product.MPN == "" {
+				product.MPN = value
+			}
+		}
+	})
+
+	c.OnHTML("#landingImage", func(e *colly.HTMLElement) {
+		product.Images = append(product.Images, e.Attr("src"))
+	})
+
 	c.OnRequest(func(r *colly.Request) {
 		fmt.Println("Visiting", r.URL.String())
 	})
@@ -15,6 +15,7 @@ func (s *ScrapperNode) DummyHandler(url string) {
 	product.Name = strconv.Itoa(rand.Int())
 	product.Price = 12.31
 	product.Rating = "4.5"
+	product.Availability = common.InStock
 	product.Description = "This is a description"
 	product.URL = url
 
@@ -33,8 +33,29 @@ func (s *ScrapperNode) NeweggProductHandler(url string) {
 		strong := e.DOM.Find("strong")
 		text := strong.Text()
 
-		temp, _ := strconv.ParseFloat(strings.TrimSpace(text), 32)
-		product.Price = float32(temp)
+		temp, _ := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(text), ",", ""), 64)
+		product.Price = temp
+	})
+
+	c.OnHTML(".product-inventory strong", func(e *colly.HTMLElement) {
+		product.Availability = parseAvailability(e.Text)
+	})
+
+	// The specifications table holds the identifiers of the manufacturer
+	c.OnHTML("#product-details table.table-horizontal tr", func(e *colly.HTMLElement) {
+		value := strings.TrimSpace(e.ChildText("td"))
+		switch strings.TrimSpace(e.ChildText("th")) {
+		case "UPC":
+			product.UPC = value
+		case "Model", "Part Number":
+			if product.MPN == "" {
+				product.MPN = value
+			}
+		}
+	})
+
+	c.OnHTML(".product-view-img-original", func(e *colly.HTMLElement) {
+		product.Images = append(product.Images, e.Attr("src"))
 	})
 
 	// Scrape the product description
@@ -45,6 +66,7 @@ func (s *ScrapperNode) NeweggProductHandler(url string) {
 	// Scrape the product rating
 	c.OnHTML(".product-rating", func(e *colly.HTMLElement) {
 		product.Rating = e.ChildAttr("i", "title")
+		product.ReviewCount = parseCount(e.ChildText(".item-rating-num"))
 	})
 
 	// Start scraping the page
@@ -7,12 +7,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // sendProductRequest marshals the product and address, then sends them to the /replicate endpoint
 func insertProduct(product common.Product, address string) error {
 	endpoint := "http://" + address + "/insert"
+
+	product = common.NormalizeProduct(product)
+	if product.ScrapedAt.IsZero() {
+		product.ScrapedAt = time.Now().UTC()
+	}
+
 	payloadBytes, err := json.Marshal(product)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %v", err)
@@ -49,3 +57,27 @@ func insertProduct(product common.Product, address string) error {
 
 	return nil
 }
+
+// parseCount extracts the number out of texts like "1,234 ratings" or "(56)"
+func parseCount(text string) int {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, text)
+
+	count, _ := strconv.Atoi(digits)
+	return count
+}
+
+func parseAvailability(text string) common.Availability {
+	text = strings.ToLower(text)
+	switch {
+	case strings.Contains(text, "out of stock"), strings.Contains(text, "unavailable"):
+		return common.OutOfStock
+	case strings.Contains(text, "in stock"):
+		return common.InStock
+	}
+	return common.UnknownAvailability
+}
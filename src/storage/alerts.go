@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Alert tells that a watched product dropped to the threshold of a rule or below
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Key       string    `json:"key"`
+	Source    string    `json:"source"`
+	Price     float64   `json:"price"`
+	Previous  float64   `json:"previous,omitempty"`
+	Threshold float64   `json:"threshold"`
+	URL       string    `json:"url"`
+	Time      time.Time `json:"time"`
+}
+
+// AlertSink delivers alerts somewhere, the sink of a rule is chosen by name from
+// alertSinks and built with the target of the rule
+type AlertSink interface {
+	Send(alert Alert) error
+}
+
+var alertSinks = map[string]func(target string) AlertSink{
+	"log":     func(target string) AlertSink { return logSink{} },
+	"webhook": func(target string) AlertSink { return webhookSink{url: target} },
+	"queue":   func(target string) AlertSink { return queueSink{topic: target} },
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+type logSink struct{}
+
+func (logSink) Send(alert Alert) error {
+	log.Printf("[ALERT] %s dropped to %.2f (threshold %.2f, rule %s) %s", alert.Key, alert.Price, alert.Threshold, alert.Rule, alert.URL)
+	return nil
+}
+
+// webhookSink posts the alert as JSON to the URL of the rule
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Send(alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := alertClient.Post(s.url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// queueSink puts the alert in a topic of the queue service
+type queueSink struct {
+	topic string
+}
+
+var (
+	queueMutex   sync.Mutex
+	queueAddress string
+)
+
+// queueHost returns the address of the queue service, it is only discovered
+// again after sending to it failed
+func queueHost() (string, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if queueAddress != "" {
+		return queueAddress, nil
+	}
+
+	found, err := common.NetDiscover("9000", "QUEUE", true, false)
+	if err != nil || len(found) == 0 || found[0] == "" {
+		return "", fmt.Errorf("queue not found: %v", err)
+	}
+	queueAddress = found[0]
+	return queueAddress, nil
+}
+
+func forgetQueueHost() {
+	queueMutex.Lock()
+	queueAddress = ""
+	queueMutex.Unlock()
+}
+
+func (s queueSink) Send(alert Alert) error {
+	host, err := queueHost()
+	if err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(struct {
+		Message string `json:"message"`
+	}{Message: string(message)})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("http://%s:9001/put?topic=%s", host, url.QueryEscape(s.topic))
+	resp, err := alertClient.Post(endpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		forgetQueueHost()
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// watches tells if the rule covers the product
+func watches(rule common.WatchRule, product common.Product) bool {
+	if rule.Key != "" {
+		return rule.Key == product.Name
+	}
+
+	values, err := url.ParseQuery(rule.Query)
+	if err != nil {
+		return false
+	}
+	q, err := parseQuery(values)
+	return err == nil && q.matches(product)
+}
+
+// priceDropped tells if the new version of the product should raise an alert: it
+// is at or below the threshold and cheaper than before, or it wasn't for sale
+func priceDropped(rule common.WatchRule, product common.Product, previous *common.Product) bool {
+	if product.Deleted || product.Price <= 0 || product.Price > rule.Threshold {
+		return false
+	}
+	return previous == nil || previous.Deleted || previous.Price <= 0 || product.Price < previous.Price
+}
+
+// evaluateWatches runs on the node coordinating a client write once it reached
+// its quorum, so every change raises its alerts once in the cluster. Copies moved
+// by repairs, rebalancing or hinted handoff never raise them again.
+func evaluateWatches(product common.Product, previous *common.Product) {
+	for _, rule := range activeWatches() {
+		if !watches(rule, product) || !priceDropped(rule, product, previous) {
+			continue
+		}
+
+		alert := Alert{
+			Rule:      rule.ID,
+			Key:       product.Name,
+			Source:    product.Source,
+			Price:     product.Price,
+			Threshold: rule.Threshold,
+			URL:       product.URL,
+			Time:      time.Now().UTC(),
+		}
+		if previous != nil && !previous.Deleted {
+			alert.Previous = previous.Price
+		}
+
+		sink := alertSinks[rule.Sink](rule.Target)
+		if err := sink.Send(alert); err != nil {
+			log.Printf("Failed to send alert of rule %s for %s: %v", rule.ID, product.Name, err)
+		}
+	}
+}
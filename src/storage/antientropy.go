@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of hosts that hold a copy of every product
+const defaultReplicas = 3
+
+// How long the owners of the local keys are trusted before they are looked up
+// again. They are also looked up again as soon as the local vnodes see a new
+// predecessor or successor.
+const rangeRefreshInterval = time.Minute
+
+var antiEntropyClient = &http.Client{Timeout: 10 * time.Second}
+
+// rangePair is a primary owner and one of the replicas of its keys
+type rangePair struct {
+	owner   string
+	replica string
+}
+
+// rangeIndex keeps a tree of the local keys of every pair of primary owner and
+// replica. The owners of the keys are looked up once per range when the index is
+// built, writes only change the trees of the pairs their key belongs to.
+type rangeIndex struct {
+	view   string
+	built  time.Time
+	owners map[string][]string
+	trees  map[rangePair]*merkleTree
+	// Trees handed out to a sync, they are copied before being changed
+	shared map[rangePair]bool
+}
+
+var (
+	rangeMutex sync.Mutex
+	ranges     *rangeIndex
+
+	// Writes queue their digests here, nil for a removed key, so they never wait
+	// for the lookups of a rebuild
+	rangeUpdatesMutex sync.Mutex
+	rangeUpdates      = make(map[string][]byte)
+)
+
+func queueRangeUpdate(name string, digest []byte) {
+	rangeUpdatesMutex.Lock()
+	rangeUpdates[name] = digest
+	rangeUpdatesMutex.Unlock()
+}
+
+func takeRangeUpdates() map[string][]byte {
+	rangeUpdatesMutex.Lock()
+	defer rangeUpdatesMutex.Unlock()
+
+	updates := rangeUpdates
+	rangeUpdates = make(map[string][]byte)
+	return updates
+}
+
+// ringView describes what the local vnodes know of their neighbours, the owners
+// of the keys near them change when it does
+func ringView(ring *chord.Ring) string {
+	var view strings.Builder
+	for _, vnode := range ring.Vnodes {
+		view.WriteString(hex.EncodeToString(vnode.Id))
+		if vnode.Predecessor != nil {
+			view.WriteString("<" + hex.EncodeToString(vnode.Predecessor.Id))
+		}
+		for _, succ := range vnode.Successors {
+			if succ != nil {
+				view.WriteString(">" + hex.EncodeToString(succ.Id))
+			}
+		}
+		view.WriteString(";")
+	}
+	return view.String()
+}
+
+// tree returns the tree of the pair, copying it first when a sync is using it
+func (index *rangeIndex) tree(pair rangePair) *merkleTree {
+	tree, ok := index.trees[pair]
+	if !ok {
+		tree = buildMerkleTree(nil)
+		index.trees[pair] = tree
+	} else if index.shared[pair] {
+		tree = tree.clone()
+		index.trees[pair] = tree
+	}
+	delete(index.shared, pair)
+	return tree
+}
+
+// set puts the digest of the key in the trees of the pairs it belongs to, nil
+// removes it
+func (index *rangeIndex) set(name string, owners []string, digest []byte) {
+	for _, host := range owners {
+		index.tree(rangePair{owner: owners[0], replica: host}).set(name, digest)
+	}
+}
+
+// buildRangeIndex looks up the owners of every local key, one lookup per range
+func buildRangeIndex(ring *chord.Ring) *rangeIndex {
+	// The digests read below already have what was queued until now
+	takeRangeUpdates()
+
+	index := &rangeIndex{
+		view:   ringView(ring),
+		built:  time.Now(),
+		owners: make(map[string][]string),
+		trees:  make(map[rangePair]*merkleTree),
+		shared: make(map[rangePair]bool),
+	}
+
+	local := localDigests()
+	names := make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+
+	entries := make(map[rangePair]map[string][]byte)
+	for name, owners := range rangeOwners(ring, names, replicaCount()) {
+		if len(owners) == 0 {
+			continue
+		}
+		index.owners[name] = owners
+		for _, host := range owners {
+			pair := rangePair{owner: owners[0], replica: host}
+			if entries[pair] == nil {
+				entries[pair] = make(map[string][]byte)
+			}
+			entries[pair][name] = local[name]
+		}
+	}
+	for pair, pairEntries := range entries {
+		index.trees[pair] = buildMerkleTree(pairEntries)
+	}
+	return index
+}
+
+// applyRangeUpdates moves the queued writes into the trees. The keys written for
+// the first time are looked up together, once per range.
+func (index *rangeIndex) applyRangeUpdates(ring *chord.Ring) {
+	var added []string
+	updates := takeRangeUpdates()
+	for name, digest := range updates {
+		if owners, ok := index.owners[name]; ok {
+			index.set(name, owners, digest)
+			if digest == nil {
+				delete(index.owners, name)
+			}
+		} else if digest != nil {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	for name, owners := range rangeOwners(ring, added, replicaCount()) {
+		if len(owners) == 0 {
+			continue
+		}
+		index.owners[name] = owners
+		index.set(name, owners, updates[name])
+	}
+}
+
+// rangeTree returns the tree of the local keys whose primary owner is owner and
+// that replica is expected to hold as well. The tree must not be changed, later
+// writes go to a copy of it.
+func rangeTree(ring *chord.Ring, owner, replica string) *merkleTree {
+	rangeMutex.Lock()
+	defer rangeMutex.Unlock()
+
+	if ranges == nil || ranges.view != ringView(ring) || time.Since(ranges.built) > rangeRefreshInterval {
+		ranges = buildRangeIndex(ring)
+	} else {
+		ranges.applyRangeUpdates(ring)
+	}
+
+	pair := rangePair{owner: owner, replica: replica}
+	tree := ranges.tree(pair)
+	ranges.shared[pair] = true
+	return tree
+}
+
+// replicaPeers returns the hosts that follow this node in the ring. The replicas of
+// the keys we are the primary owner of are among them, not always the closest
+// ones since they are spread across zones, rangeTree keeps the keys each of
+// them actually holds.
+func replicaPeers(ring *chord.Ring) []string {
+	var peers []string
+	for _, vnode := range ring.Vnodes {
+		for _, succ := range vnode.Successors {
+			if succ == nil || succ.Host == addr {
+				continue
+			}
+			if !contains(peers, succ.Host) {
+				peers = append(peers, succ.Host)
+			}
+		}
+	}
+	return peers
+}
+
+// antiEntropy compares the tree of every range we own with the replicas of that
+// range and only syncs the keys under the subtrees that differ
+func antiEntropy(ring *chord.Ring) {
+	for _, peer := range replicaPeers(ring) {
+		tree := rangeTree(ring, addr, peer)
+		if err := syncWithReplica(peer, tree); err != nil {
+			log.Printf("Anti-entropy with %s failed: %v", peer, err)
+		}
+	}
+}
+
+func syncWithReplica(peer string, tree *merkleTree) error {
+	remote, err := fetchMerkleNodes(peer, []int{0})
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(remote[0], tree.nodes[0]) {
+		return nil
+	}
+
+	// Walk down the tree one level at a time following the nodes that differ
+	frontier := []int{0}
+	for !isMerkleLeaf(frontier[0]) {
+		var children []int
+		for _, i := range frontier {
+			children = append(children, 2*i+1, 2*i+2)
+		}
+
+		remote, err = fetchMerkleNodes(peer, children)
+		if err != nil {
+			return err
+		}
+
+		frontier = frontier[:0]
+		for _, i := range children {
+			if !bytes.Equal(remote[i], tree.nodes[i]) {
+				frontier = append(frontier, i)
+			}
+		}
+		if len(frontier) == 0 {
+			return nil
+		}
+	}
+
+	// Send what we have and take what they have, versions decide the winner
+	var push, pull []string
+	for _, i := range frontier {
+		remoteLeaf, err := fetchMerkleLeaf(peer, i)
+		if err != nil {
+			return err
+		}
+
+		localLeaf := tree.leaf(i)
+		for _, name := range diffLeaves(localLeaf, remoteLeaf) {
+			if _, ok := localLeaf[name]; ok {
+				push = append(push, name)
+			}
+			if _, ok := remoteLeaf[name]; ok {
+				pull = append(pull, name)
+			}
+		}
+	}
+
+	if len(push) > 0 {
+		if _, err := pushRecords(peer, push); err != nil {
+			log.Printf("Error while pushing %d products to %s: %v", len(push), peer, err)
+		}
+	}
+	if len(pull) > 0 {
+		if err := pullRecords(peer, pull); err != nil {
+			log.Printf("Error while pulling %d products from %s: %v", len(pull), peer, err)
+		}
+	}
+
+	return nil
+}
+
+func fetchMerkleNodes(peer string, nodes []int) (map[int][]byte, error) {
+	indexes := make([]string, len(nodes))
+	for i, node := range nodes {
+		indexes[i] = strconv.Itoa(node)
+	}
+
+	endpoint := fmt.Sprintf("http://%s/merkle?owner=%s&nodes=%s", httpAddress(peer), url.QueryEscape(addr), strings.Join(indexes, ","))
+
+	var encoded map[int]string
+	if err := getJSON(endpoint, &encoded); err != nil {
+		return nil, err
+	}
+
+	return decodeHashes(encoded)
+}
+
+func fetchMerkleLeaf(peer string, leaf int) (map[string][]byte, error) {
+	endpoint := fmt.Sprintf("http://%s/merkle/leaf?owner=%s&leaf=%d", httpAddress(peer), url.QueryEscape(addr), leaf)
+
+	var encoded map[string]string
+	if err := getJSON(endpoint, &encoded); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]byte, len(encoded))
+	for name, digest := range encoded {
+		decoded, err := hex.DecodeString(digest)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = decoded
+	}
+	return result, nil
+}
+
+func decodeHashes(encoded map[int]string) (map[int][]byte, error) {
+	result := make(map[int][]byte, len(encoded))
+	for i, hash := range encoded {
+		decoded, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = decoded
+	}
+	return result, nil
+}
+
+func getJSON(endpoint string, v interface{}) error {
+	resp, err := antiEntropyClient.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func merkleHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Missing owner", http.StatusBadRequest)
+		return
+	}
+
+	tree := rangeTree(ring, owner, addr)
+
+	result := make(map[int]string)
+	for _, field := range strings.Split(r.URL.Query().Get("nodes"), ",") {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 0 || i >= len(tree.nodes) {
+			http.Error(w, "Bad node index", http.StatusBadRequest)
+			return
+		}
+		result[i] = hex.EncodeToString(tree.nodes[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func merkleLeafHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Missing owner", http.StatusBadRequest)
+		return
+	}
+
+	i, err := strconv.Atoi(r.URL.Query().Get("leaf"))
+	if err != nil || !isMerkleLeaf(i) || i >= 2*merkleLeaves-1 {
+		http.Error(w, "Bad leaf index", http.StatusBadRequest)
+		return
+	}
+
+	result := make(map[string]string)
+	for name, digest := range rangeTree(ring, owner, addr).leaf(i) {
+		result[name] = hex.EncodeToString(digest)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	common "commons"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ArchiveSegment describes old price points of a product moved to the cold tier.
+// The points are encoded as JSON and erasure coded into DataShards shards plus
+// ParityShards parity shards, each one kept by a different host. Any DataShards
+// of them are enough to read the points back, so a segment costs
+// (k+m)/k times its size instead of one full copy per replica.
+type ArchiveSegment struct {
+	ID           string    `json:"id"`
+	Key          string    `json:"key"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Points       int       `json:"points"`
+	Size         int       `json:"size"`
+	DataShards   int       `json:"data_shards"`
+	ParityShards int       `json:"parity_shards"`
+	// Holders[i] keeps the shard i, whose checksum is ShardChecksums[i]
+	Holders []string `json:"holders"`
+	// The times of the archived points in nanoseconds, owners drop exactly those
+	Times          []int64        `json:"times,omitempty"`
+	ShardChecksums []string       `json:"shard_checksums"`
+	Checksum       string         `json:"checksum"`
+	Version        common.Version `json:"version"`
+}
+
+var (
+	// Price points older than this are moved to the cold tier, 0 leaves the tier
+	// disabled
+	archiveAfter        time.Duration
+	archiveDataShards   = 2
+	archiveParityShards = 1
+)
+
+// loadArchiveConfig enables the cold tier when ARCHIVE_AFTER is set. Every shard
+// of a segment needs its own host among the successors of the key, so k+m can't
+// be bigger than a lookup returns.
+func loadArchiveConfig() {
+	raw := os.Getenv("ARCHIVE_AFTER")
+	if raw == "" {
+		return
+	}
+
+	after, err := time.ParseDuration(raw)
+	if err != nil || after <= 0 {
+		log.Printf("Invalid ARCHIVE_AFTER %s, the cold tier is disabled", raw)
+		return
+	}
+
+	k := envInt("ARCHIVE_DATA_SHARDS", archiveDataShards)
+	m := envInt("ARCHIVE_PARITY_SHARDS", archiveParityShards)
+	if k+m > maxReplicas() {
+		log.Printf("The cold tier needs %d hosts but a lookup returns at most %d, it is disabled", k+m, maxReplicas())
+		return
+	}
+
+	archiveAfter, archiveDataShards, archiveParityShards = after, k, m
+	log.Printf("Archiving price points older than %s with %d data and %d parity shards", after, k, m)
+}
+
+func archiveDir() string {
+	return filepath.Join(addr, "archive")
+}
+
+func manifestsDir() string {
+	return filepath.Join(archiveDir(), "manifests")
+}
+
+func manifestPath(name string) string {
+	return filepath.Join(manifestsDir(), keyFile(name))
+}
+
+func shardPath(segment string, index int) string {
+	return filepath.Join(archiveDir(), "shards", fmt.Sprintf("%s.%d", segment, index))
+}
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Segment ids end up in file names, only the ids we generate are accepted
+func validSegmentID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return id != "" && err == nil
+}
+
+// archiveMutex guards the manifests, it is never held while taking historyMutex
+var archiveMutex sync.Mutex
+
+// readManifest returns the archived segments of a product known by this node
+func readManifest(name string) ([]ArchiveSegment, error) {
+	data, err := os.ReadFile(manifestPath(name))
+	if os.IsNotExist(err) {
+		return []ArchiveSegment{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []ArchiveSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func listManifests() ([]string, error) {
+	files, err := os.ReadDir(manifestsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if name, ok := keyOfFile(file.Name()); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// covers tells if the point at the time was archived in the segment. Segments
+// written before their times were kept cover every point between From and To.
+func (segment ArchiveSegment) covers(t time.Time) bool {
+	if len(segment.Times) == 0 {
+		return !t.Before(segment.From) && !t.After(segment.To)
+	}
+	for _, archived := range segment.Times {
+		if archived == t.UnixNano() {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedFilter tells which points of the product were moved to the cold tier,
+// only those are kept out of the hot history
+func archivedFilter(name string) func(time.Time) bool {
+	archiveMutex.Lock()
+	segments, err := readManifest(name)
+	archiveMutex.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to read the archive manifest of %s: %v", name, err)
+	}
+
+	times := make(map[int64]bool)
+	var legacy []ArchiveSegment
+	for _, segment := range segments {
+		if len(segment.Times) == 0 {
+			legacy = append(legacy, segment)
+		}
+		for _, t := range segment.Times {
+			times[t] = true
+		}
+	}
+
+	return func(t time.Time) bool {
+		if times[t.UnixNano()] {
+			return true
+		}
+		for _, segment := range legacy {
+			if segment.covers(t) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// storeSegment keeps the segment in the manifest of its product unless the local
+// copy is at least as new, then drops the hot points it covers
+func storeSegment(segment ArchiveSegment) (bool, error) {
+	archiveMutex.Lock()
+
+	segments, err := readManifest(segment.Key)
+	if err != nil {
+		archiveMutex.Unlock()
+		return false, err
+	}
+
+	replaced := false
+	for i, current := range segments {
+		if current.ID != segment.ID {
+			continue
+		}
+		if current.Version.Compare(segment.Version) >= 0 {
+			archiveMutex.Unlock()
+			return false, nil
+		}
+		segments[i] = segment
+		replaced = true
+	}
+	if !replaced {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].From.Before(segments[j].From)
+	})
+
+	data, err := json.MarshalIndent(segments, "", "  ")
+	if err == nil {
+		err = walWrite(manifestPath(segment.Key), data)
+	}
+	archiveMutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	return true, trimHistory(segment.Key, segment)
+}
+
+// trimHistory drops the hot points archived in the segment. A point only this
+// node has is kept even if it is older, the primary archives it later.
+func trimHistory(name string, segment ArchiveSegment) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	current, err := readHistory(name)
+	if err != nil {
+		return err
+	}
+
+	kept := []common.PricePoint{}
+	for _, point := range current {
+		if !segment.covers(point.Time) {
+			kept = append(kept, point)
+		}
+	}
+	if len(kept) == len(current) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+	return walWrite(historyPath(name), data)
+}
+
+// mergePoints returns the points of both lists sorted by time without duplicates
+func mergePoints(a []common.PricePoint, b []common.PricePoint) []common.PricePoint {
+	seen := make(map[int64]bool)
+	merged := []common.PricePoint{}
+	for _, points := range [][]common.PricePoint{a, b} {
+		for _, point := range points {
+			if seen[point.Time.UnixNano()] {
+				continue
+			}
+			seen[point.Time.UnixNano()] = true
+			merged = append(merged, point)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	return merged
+}
+
+func shardEndpoint(host string, segment string, index int) string {
+	return fmt.Sprintf("http://%s/archive/shard?segment=%s&index=%d", httpAddress(host), segment, index)
+}
+
+func sendShard(host string, segment string, index int, shard []byte) error {
+	if host == addr {
+		return writeFileAtomic(shardPath(segment, index), shard)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, shardEndpoint(host, segment, index), bytes.NewReader(shard))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := antiEntropyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// fetchShard reads the shard from its holder and checks it against the manifest
+func fetchShard(segment ArchiveSegment, index int) ([]byte, error) {
+	var shard []byte
+	var err error
+
+	host := segment.Holders[index]
+	if host == addr {
+		shard, err = os.ReadFile(shardPath(segment.ID, index))
+	} else {
+		var resp *http.Response
+		resp, err = antiEntropyClient.Get(shardEndpoint(host, segment.ID, index))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+		}
+		shard, err = io.ReadAll(resp.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if checksumOf(shard) != segment.ShardChecksums[index] {
+		return nil, errCorrupt
+	}
+	return shard, nil
+}
+
+// shardExists tells if the holder still keeps the shard, an error means it
+// couldn't be asked
+func shardExists(host string, segment string, index int) (bool, error) {
+	if host == addr {
+		_, err := os.Stat(shardPath(segment, index))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	resp, err := antiEntropyClient.Head(shardEndpoint(host, segment, index))
+	if err != nil {
+		return false, fmt.Errorf("failed to send request: %v", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+}
+
+func deleteShard(host string, segment string, index int) error {
+	if host == addr {
+		err := os.Remove(shardPath(segment, index))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, shardEndpoint(host, segment, index), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := antiEntropyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendSegment(segment ArchiveSegment, host string) error {
+	if host == addr {
+		_, err := storeSegment(segment)
+		return err
+	}
+
+	payload, err := json.Marshal(segment)
+	if err != nil {
+		return err
+	}
+
+	resp, err := antiEntropyClient.Post("http://"+httpAddress(host)+"/archive/manifest", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// shardHolders returns the successors of the key that may keep shards, spread
+// across zones and leaving out the given hosts
+func shardHolders(ring *chord.Ring, key string, exclude []string) ([]string, error) {
+	successors, err := ring.Lookup(lookupWidth(ring), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, zones := successorHosts(successors)
+
+	var holders []string
+	for _, host := range placeReplicas(hosts, len(hosts), func(host string) string { return zones[host] }) {
+		if !contains(exclude, host) {
+			holders = append(holders, host)
+		}
+	}
+	return holders, nil
+}
+
+// gatherShards fetches the data shards first, parity shards only stand in for the
+// ones that can't be fetched. Missing shards are left nil.
+func gatherShards(segment ArchiveSegment) ([][]byte, error) {
+	shards := make([][]byte, len(segment.Holders))
+
+	found := 0
+	for i := range segment.Holders {
+		if found == segment.DataShards {
+			break
+		}
+		shard, err := fetchShard(segment, i)
+		if err != nil {
+			log.Printf("Failed to fetch shard %d of segment %s from %s: %v", i, segment.ID, segment.Holders[i], err)
+			continue
+		}
+		shards[i] = shard
+		found++
+	}
+
+	if found < segment.DataShards {
+		return nil, fmt.Errorf("only %d of the %d shards needed for segment %s are available", found, segment.DataShards, segment.ID)
+	}
+	return shards, nil
+}
+
+// readSegment rebuilds the points of an archived segment
+func readSegment(segment ArchiveSegment) ([]common.PricePoint, error) {
+	rs, err := newReedSolomon(segment.DataShards, segment.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := gatherShards(segment)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return nil, err
+	}
+
+	data, err := rs.join(shards, segment.Size)
+	if err != nil {
+		return nil, err
+	}
+	if checksumOf(data) != segment.Checksum {
+		return nil, errCorrupt
+	}
+
+	var points []common.PricePoint
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// readArchivedHistory returns every archived point of the product
+func readArchivedHistory(name string) ([]common.PricePoint, error) {
+	archiveMutex.Lock()
+	segments, err := readManifest(name)
+	archiveMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []common.PricePoint{}
+	for _, segment := range segments {
+		archived, err := readSegment(segment)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %v", segment.ID, err)
+		}
+		points = append(points, archived...)
+	}
+	return points, nil
+}
+
+// archivePoints erasure codes the points into a new segment and stores a shard on
+// each holder. The owners only drop the hot points once every shard is stored.
+func archivePoints(ring *chord.Ring, name string, points []common.PricePoint, owners []string) error {
+	rs, err := newReedSolomon(archiveDataShards, archiveParityShards)
+	if err != nil {
+		return err
+	}
+
+	holders, err := shardHolders(ring, name, nil)
+	if err != nil {
+		return err
+	}
+	if len(holders) < rs.totalShards() {
+		return fmt.Errorf("%d shards need as many hosts, only %d are available", rs.totalShards(), len(holders))
+	}
+	holders = holders[:rs.totalShards()]
+
+	data, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	shards := rs.split(data)
+	rs.encode(shards)
+
+	segment := ArchiveSegment{
+		ID:           newID(),
+		Key:          name,
+		From:         points[0].Time,
+		To:           points[len(points)-1].Time,
+		Points:       len(points),
+		Size:         len(data),
+		DataShards:   rs.dataShards,
+		ParityShards: rs.parityShards,
+		Holders:      holders,
+		Checksum:     checksumOf(data),
+	}
+	for _, point := range points {
+		segment.Times = append(segment.Times, point.Time.UnixNano())
+	}
+
+	for i, shard := range shards {
+		segment.ShardChecksums = append(segment.ShardChecksums, checksumOf(shard))
+
+		if err := sendShard(holders[i], segment.ID, i, shard); err != nil {
+			// Don't leave the shards of a segment nobody knows about behind
+			for j := 0; j < i; j++ {
+				deleteShard(holders[j], segment.ID, j)
+			}
+			return fmt.Errorf("%s didn't store shard %d: %v", holders[i], i, err)
+		}
+	}
+
+	segment.Version = clock.Now()
+
+	// Owners that miss it now get it when the archive is repaired, they keep
+	// their hot points until then
+	for _, owner := range owners {
+		if err := sendSegment(segment, owner); err != nil {
+			log.Printf("Failed to send segment %s of %s to %s: %v", segment.ID, name, owner, err)
+		}
+	}
+
+	log.Printf("Archived %d points of %s into segment %s on %v", len(points), name, segment.ID, holders)
+	return nil
+}
+
+// archiveHistory moves the points older than archiveAfter of the products this
+// node is the primary owner of to the cold tier
+func archiveHistory(ring *chord.Ring) {
+	cutoff := time.Now().Add(-archiveAfter)
+
+	for name := range localDigests() {
+		owners, err := ownersOf(ring, name, replicaCount())
+		if err != nil || len(owners) == 0 || owners[0] != addr {
+			continue
+		}
+
+		history, err := readHistory(name)
+		if err != nil {
+			log.Printf("Failed to read history of %s: %v", name, err)
+			continue
+		}
+
+		var cold []common.PricePoint
+		for _, point := range history {
+			if point.Time.Before(cutoff) {
+				cold = append(cold, point)
+			}
+		}
+		if len(cold) == 0 {
+			continue
+		}
+
+		if err := archivePoints(ring, name, cold, owners); err != nil {
+			log.Printf("Failed to archive the history of %s: %v", name, err)
+		}
+	}
+}
+
+// repairSegment moves the shards whose holder left the ring or lost them to other
+// successors of the key, rebuilding them from the remaining shards. It returns
+// whether the holders changed.
+func repairSegment(ring *chord.Ring, segment *ArchiveSegment, members []string) (bool, error) {
+	var lost []int
+	var kept []string
+	for i, holder := range segment.Holders {
+		if !contains(members, holder) {
+			lost = append(lost, i)
+			continue
+		}
+		// A holder we can't ask now is not considered lost yet
+		if exists, err := shardExists(holder, segment.ID, i); err == nil && !exists {
+			lost = append(lost, i)
+			continue
+		}
+		kept = append(kept, holder)
+	}
+	if len(lost) == 0 {
+		return false, nil
+	}
+
+	rs, err := newReedSolomon(segment.DataShards, segment.ParityShards)
+	if err != nil {
+		return false, err
+	}
+	shards, err := gatherShards(*segment)
+	if err != nil {
+		return false, err
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return false, err
+	}
+
+	candidates, err := shardHolders(ring, segment.Key, kept)
+	if err != nil {
+		return false, err
+	}
+
+	holders := append([]string(nil), segment.Holders...)
+	for _, i := range lost {
+		placed := false
+		for len(candidates) > 0 && !placed {
+			host := candidates[0]
+			candidates = candidates[1:]
+
+			if err := sendShard(host, segment.ID, i, shards[i]); err != nil {
+				log.Printf("%s didn't store shard %d of segment %s: %v", host, i, segment.ID, err)
+				continue
+			}
+			log.Printf("Rebuilt shard %d of segment %s on %s, it was on %s", i, segment.ID, host, holders[i])
+			holders[i] = host
+			placed = true
+		}
+		if !placed {
+			segment.Holders = holders
+			return true, fmt.Errorf("no host left for shard %d", i)
+		}
+	}
+
+	segment.Holders = holders
+	return true, nil
+}
+
+// repairArchive checks the segments of the products this node is the primary
+// owner of and sends their manifests to the current owners, so owners that missed
+// a segment or joined later learn it
+func repairArchive(ring *chord.Ring) {
+	names, err := listManifests()
+	if err != nil {
+		log.Printf("Failed to list archive manifests: %v", err)
+		return
+	}
+
+	members := clusterHosts(ring)
+	for _, name := range names {
+		owners, err := ownersOf(ring, name, replicaCount())
+		if err != nil || len(owners) == 0 || owners[0] != addr {
+			continue
+		}
+
+		archiveMutex.Lock()
+		segments, err := readManifest(name)
+		archiveMutex.Unlock()
+		if err != nil {
+			log.Printf("Failed to read the archive manifest of %s: %v", name, err)
+			continue
+		}
+
+		for _, segment := range segments {
+			changed, err := repairSegment(ring, &segment, members)
+			if err != nil {
+				log.Printf("Failed to repair segment %s of %s: %v", segment.ID, name, err)
+			}
+			if changed {
+				segment.Version = clock.Now()
+			}
+
+			for _, owner := range owners {
+				if err := sendSegment(segment, owner); err != nil {
+					log.Printf("Failed to send segment %s of %s to %s: %v", segment.ID, name, owner, err)
+				}
+			}
+		}
+	}
+}
+
+// handOffArchive sends the manifest of the product to its new owners when this
+// node stops owning it, the shards stay where they are
+func handOffArchive(name string, owners []string) error {
+	archiveMutex.Lock()
+	segments, err := readManifest(name)
+	archiveMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		for _, owner := range owners {
+			if err := sendSegment(segment, owner); err != nil {
+				return fmt.Errorf("%s didn't take segment %s: %v", owner, segment.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// forgetArchive removes the local manifest of the product
+func forgetArchive(name string) error {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	if _, err := os.Stat(manifestPath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	return walRemove(manifestPath(name))
+}
+
+// dropArchive deletes the archived history of a removed product, holders that
+// can't be reached keep their shard
+func dropArchive(name string) error {
+	archiveMutex.Lock()
+	segments, err := readManifest(name)
+	archiveMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		for i, holder := range segment.Holders {
+			if err := deleteShard(holder, segment.ID, i); err != nil {
+				log.Printf("Failed to delete shard %d of segment %s from %s: %v", i, segment.ID, holder, err)
+			}
+		}
+	}
+	return forgetArchive(name)
+}
+
+func Archive(ring *chord.Ring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		archiveHistory(ring)
+		repairArchive(ring)
+	}
+}
+
+// archiveShardHandler serves, stores and deletes the shards this node holds
+func archiveShardHandler(w http.ResponseWriter, r *http.Request) {
+	segment := r.URL.Query().Get("segment")
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if !validSegmentID(segment) || err != nil || index < 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, err := os.ReadFile(shardPath(segment, index))
+		if os.IsNotExist(err) {
+			http.Error(w, "Shard not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read shard", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if err := writeFileAtomic(shardPath(segment, index), data); err != nil {
+			log.Printf("Failed to store shard %d of segment %s: %v", index, segment, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := os.Remove(shardPath(segment, index)); err != nil && !os.IsNotExist(err) {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// archiveManifestHandler shows the segments of a product known by this node or
+// stores one sent by its primary owner
+func archiveManifestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "Missing key", http.StatusBadRequest)
+			return
+		}
+
+		archiveMutex.Lock()
+		segments, err := readManifest(key)
+		archiveMutex.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to read the archive manifest", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(segments)
+	case http.MethodPost:
+		var segment ArchiveSegment
+		if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if segment.Key == "" || !validSegmentID(segment.ID) || len(segment.Holders) != segment.DataShards+segment.ParityShards ||
+			len(segment.ShardChecksums) != len(segment.Holders) {
+			http.Error(w, "Invalid segment", http.StatusBadRequest)
+			return
+		}
+
+		clock.Observe(segment.Version)
+		if _, err := storeSegment(segment); err != nil {
+			log.Printf("Failed to store segment %s of %s: %v", segment.ID, segment.Key, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	common "commons"
+	"testing"
+	"time"
+)
+
+func TestStoreSegmentTrimsHistory(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	points := []common.PricePoint{
+		{Time: start, Price: 30},
+		{Time: start.Add(time.Hour), Price: 25},
+		{Time: start.Add(2 * time.Hour), Price: 20},
+	}
+	if err := mergeHistory("product", points); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := ArchiveSegment{
+		ID:      "0a1b",
+		Key:     "product",
+		From:    start,
+		To:      start.Add(time.Hour),
+		Version: common.Version{WallTime: 1, Node: "a"},
+	}
+	if written, err := storeSegment(segment); err != nil || !written {
+		t.Fatalf("expected the segment to be stored, %v", err)
+	}
+
+	history, err := readHistory("product")
+	if err != nil || len(history) != 1 || history[0].Price != 20 {
+		t.Fatalf("unexpected hot history %+v %v", history, err)
+	}
+
+	// Replicas that missed the segment may send the archived points again
+	if err := mergeHistory("product", points); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := readHistory("product"); len(history) != 1 {
+		t.Fatalf("archived points came back %+v", history)
+	}
+
+	if written, _ := storeSegment(segment); written {
+		t.Fatal("expected the same version to be ignored")
+	}
+}
+
+func TestStoreSegmentKeepsUnarchivedPoints(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// The primary archived the first and last points, it never got the middle one
+	archived := []common.PricePoint{{Time: start, Price: 30}, {Time: start.Add(2 * time.Hour), Price: 20}}
+	late := common.PricePoint{Time: start.Add(time.Hour), Price: 25}
+	if err := mergeHistory("product", append([]common.PricePoint{late}, archived...)); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := ArchiveSegment{
+		ID:      "0a1c",
+		Key:     "product",
+		From:    start,
+		To:      start.Add(2 * time.Hour),
+		Times:   []int64{archived[0].Time.UnixNano(), archived[1].Time.UnixNano()},
+		Version: common.Version{WallTime: 1, Node: "a"},
+	}
+	if _, err := storeSegment(segment); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := readHistory("product")
+	if err != nil || len(history) != 1 || history[0].Price != 25 {
+		t.Fatalf("expected only the point missing from the segment to stay, got %+v %v", history, err)
+	}
+
+	// Other replicas can still send it to the nodes that dropped it
+	addr = t.TempDir()
+	storeSegment(segment)
+	if err := mergeHistory("product", []common.PricePoint{late}); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := readHistory("product"); len(history) != 1 {
+		t.Fatalf("expected the late point to be merged, got %+v", history)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	common "commons"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BulkRecord is a product together with its hot history as it travels between
+// nodes in bulk. Records are sent as gzip compressed NDJSON.
+type BulkRecord struct {
+	Product common.Product      `json:"product"`
+	History []common.PricePoint `json:"history,omitempty"`
+}
+
+var (
+	// How many records go in a batch, and how often a stream is flushed
+	bulkBatchSize = 500
+	// How many batches a node applies at the same time, senders beyond that are
+	// told to come back later
+	bulkSlots = make(chan struct{}, 2)
+)
+
+const bulkMaxRetries = 5
+
+// replicationClient is shared by the requests that replicate a single product, so
+// connections to the other nodes are reused
+var replicationClient = &http.Client{Timeout: 10 * time.Second}
+
+// bulkClient has no overall timeout since a stream lasts as long as there are
+// records to send, only the wait for the response to start is bounded
+var bulkClient = &http.Client{
+	Transport: &http.Transport{
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	},
+}
+
+func loadBulkConfig() {
+	bulkBatchSize = envInt("BULK_BATCH_SIZE", bulkBatchSize)
+	bulkSlots = make(chan struct{}, envInt("BULK_MAX_INFLIGHT", cap(bulkSlots)))
+}
+
+// readRecord returns the local copy of a product with its history
+func readRecord(name string) (BulkRecord, bool, error) {
+	product, found, err := readProduct(name)
+	if err != nil || !found {
+		return BulkRecord{}, found, err
+	}
+
+	history, err := readHistory(name)
+	if err != nil {
+		return BulkRecord{}, false, err
+	}
+	return BulkRecord{Product: product, History: history}, true, nil
+}
+
+// applyRecord stores a record received from another node, the versions decide
+// whether it replaces the local copy. Whether we hold the primary copy is
+// decided here like the scrubber does, the sender may have an older view of the
+// ring.
+func applyRecord(record BulkRecord) (bool, error) {
+	product := record.Product
+	if !common.VerifyChecksum(product) {
+		return false, errCorrupt
+	}
+
+	owners, err := ownersOf(ring, product.Name, replicaCount())
+	product.Replicated = err != nil || len(owners) == 0 || owners[0] != addr
+
+	clock.Observe(product.Version)
+	written, err := storeProduct(product)
+	if err != nil {
+		return false, err
+	}
+
+	if len(record.History) > 0 {
+		if err := mergeHistory(product.Name, record.History); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func encodeRecords(w io.Writer, records []BulkRecord) error {
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// decodeRecords reads a compressed stream of records and hands them to apply as
+// they arrive
+func decodeRecords(r io.Reader, apply func(BulkRecord) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	for {
+		var record BulkRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := apply(record); err != nil {
+			return err
+		}
+	}
+}
+
+// BatchResult is what a node did with a batch, the records it couldn't apply are
+// skipped and listed by key
+type BatchResult struct {
+	Applied int      `json:"applied"`
+	Written int      `json:"written"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// sendBatch posts one batch and waits until the peer applied it, returning the
+// keys the peer skipped. A busy peer answers 503 with a Retry-After, the batch is
+// sent again after waiting so a node is never sent more than it can apply.
+func sendBatch(peer string, records []BulkRecord) ([]string, error) {
+	var body bytes.Buffer
+	if err := encodeRecords(&body, records); err != nil {
+		return nil, err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, "http://"+httpAddress(peer)+"/replicate/batch", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Content-Encoding", "gzip")
+
+		resp, err := bulkClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %v", err)
+		}
+
+		var result BatchResult
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode the batch result: %v", err)
+			}
+			return result.Skipped, nil
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			if attempt == bulkMaxRetries {
+				return nil, fmt.Errorf("%s is still busy after %d attempts", peer, attempt+1)
+			}
+			wait := backoff
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+			time.Sleep(wait)
+			backoff *= 2
+		default:
+			return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+		}
+	}
+}
+
+// pushRecords sends the products to the peer in batches and returns the versions
+// it acknowledged. It stops at the first batch that fails, what was acknowledged
+// until then is kept by the peer.
+func pushRecords(peer string, names []string) ([]common.Product, error) {
+	var acked []common.Product
+
+	for start := 0; start < len(names); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+
+		var records []BulkRecord
+		for _, name := range names[start:end] {
+			record, found, err := readRecord(name)
+			if err != nil {
+				log.Printf("Failed to read %s: %v", name, err)
+				continue
+			}
+			if found {
+				records = append(records, record)
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		skipped, err := sendBatch(peer, records)
+		if err != nil {
+			return acked, err
+		}
+		if len(skipped) > 0 {
+			log.Printf("%s skipped %d records: %s", peer, len(skipped), strings.Join(skipped, ", "))
+		}
+		for _, record := range records {
+			if !contains(skipped, record.Product.Name) {
+				acked = append(acked, record.Product)
+			}
+		}
+	}
+
+	return acked, nil
+}
+
+// streamRecords sends the request for a stream of records and applies them as
+// they arrive. The peer only writes as fast as we read, so a slow node is not
+// flooded.
+func streamRecords(req *http.Request, apply func(BulkRecord) error) error {
+	// Asking for gzip ourselves keeps the transport from decompressing it
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := bulkClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return decodeRecords(resp.Body, apply)
+}
+
+// pullRecords fetches the given products from the peer
+func pullRecords(peer string, names []string) error {
+	payload, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+httpAddress(peer)+"/replicate/stream", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	skipped := 0
+	err = streamRecords(req, func(record BulkRecord) error {
+		if _, err := applyRecord(record); err != nil {
+			// One bad record doesn't hold back the others
+			log.Printf("Skipping %s from %s: %v", record.Product.Name, peer, err)
+			skipped++
+		}
+		return nil
+	})
+	if skipped > 0 {
+		log.Printf("Skipped %d of the records pulled from %s", skipped, peer)
+	}
+	return err
+}
+
+// BulkCheckpoint is how far the bootstrap from a peer got, the records are sent
+// in key order so it resumes after the last key applied
+type BulkCheckpoint struct {
+	Peer    string    `json:"peer"`
+	After   string    `json:"after"`
+	Updated time.Time `json:"updated"`
+}
+
+func checkpointsDir() string {
+	return filepath.Join(addr, "bulk")
+}
+
+func checkpointPath(peer string) string {
+	return filepath.Join(checkpointsDir(), fmt.Sprintf("%s.json", peer))
+}
+
+func writeCheckpoint(checkpoint BulkCheckpoint) error {
+	checkpoint.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(checkpointPath(checkpoint.Peer), data)
+}
+
+// readCheckpoints returns the bootstraps that didn't finish
+func readCheckpoints() ([]BulkCheckpoint, error) {
+	files, err := os.ReadDir(checkpointsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoints []BulkCheckpoint
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(checkpointsDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var checkpoint BulkCheckpoint
+		if err := json.Unmarshal(data, &checkpoint); err != nil {
+			log.Printf("Skipping unreadable checkpoint %s: %v", file.Name(), err)
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, nil
+}
+
+// bootstrapFrom streams the products this node owns from the peer, saving the
+// checkpoint after every batch
+func bootstrapFrom(checkpoint BulkCheckpoint) error {
+	values := url.Values{}
+	values.Set("for", addr)
+	values.Set("after", checkpoint.After)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+httpAddress(checkpoint.Peer)+"/replicate/stream?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	count, skipped := 0, 0
+	err = streamRecords(req, func(record BulkRecord) error {
+		if _, err := applyRecord(record); err != nil {
+			// Retrying wouldn't fix it, anti-entropy gets the key later
+			log.Printf("Skipping %s from %s: %v", record.Product.Name, checkpoint.Peer, err)
+			skipped++
+		}
+
+		checkpoint.After = record.Product.Name
+		count++
+		if count%bulkBatchSize == 0 {
+			return writeCheckpoint(checkpoint)
+		}
+		return nil
+	})
+	if err != nil {
+		if err := writeCheckpoint(checkpoint); err != nil {
+			log.Printf("Failed to save the checkpoint of %s: %v", checkpoint.Peer, err)
+		}
+		return err
+	}
+
+	log.Printf("Bootstrapped %d products from %s, skipped %d", count-skipped, checkpoint.Peer, skipped)
+	return os.Remove(checkpointPath(checkpoint.Peer))
+}
+
+// bootstrapNode pulls the products this node owns from the rest of the cluster when
+// it joins without data. A checkpoint is written for every peer before starting,
+// so a bootstrap interrupted by a restart resumes with the peers left.
+func bootstrapNode(ring *chord.Ring) {
+	// Let the ring stabilize first so the rest of the cluster is known
+	time.Sleep(5 * time.Second)
+
+	checkpoints, err := readCheckpoints()
+	if err != nil {
+		log.Printf("Failed to read the bootstrap checkpoints: %v", err)
+		return
+	}
+
+	if len(checkpoints) == 0 {
+		if len(localDigests()) > 0 {
+			// Anti-entropy takes care of what changed while we were away
+			return
+		}
+
+		for _, host := range clusterHosts(ring) {
+			if host == addr {
+				continue
+			}
+			checkpoint := BulkCheckpoint{Peer: host}
+			if err := writeCheckpoint(checkpoint); err != nil {
+				log.Printf("Failed to save the checkpoint of %s: %v", host, err)
+				return
+			}
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+
+	for _, checkpoint := range checkpoints {
+		backoff := time.Second
+		for attempt := 0; attempt < bulkMaxRetries; attempt++ {
+			err := bootstrapFrom(checkpoint)
+			if err == nil {
+				break
+			}
+			log.Printf("Bootstrap from %s failed after %q: %v", checkpoint.Peer, checkpoint.After, err)
+			time.Sleep(backoff)
+			backoff *= 2
+
+			// Pick up where the failed attempt stopped
+			if saved, err := os.ReadFile(checkpointPath(checkpoint.Peer)); err == nil {
+				json.Unmarshal(saved, &checkpoint)
+			}
+		}
+	}
+}
+
+// batchHandler applies a batch of records sent by another node
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	select {
+	case bulkSlots <- struct{}{}:
+		defer func() { <-bulkSlots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many batches in flight", http.StatusServiceUnavailable)
+		return
+	}
+
+	// A record that can't be applied is skipped and reported, the sender keeps
+	// it and the rest of the batch still goes through
+	var result BatchResult
+	err := decodeRecords(r.Body, func(record BulkRecord) error {
+		stored, err := applyRecord(record)
+		if err != nil {
+			log.Printf("Skipping %s in a batch: %v", record.Product.Name, err)
+			result.Skipped = append(result.Skipped, record.Product.Name)
+			return nil
+		}
+		result.Applied++
+		if stored {
+			result.Written++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read a batch after %d records: %v", result.Applied, err)
+		http.Error(w, "Failed to read the batch", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Applied a batch of %d records, %d were newer, %d skipped", result.Applied, result.Written, len(result.Skipped))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// streamHandler streams records in key order. A GET streams the products owned by
+// the host in for after the given key, a POST streams the keys in the body.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	var owner string
+
+	switch r.Method {
+	case http.MethodGet:
+		owner = r.URL.Query().Get("for")
+		if owner == "" {
+			http.Error(w, "Missing for", http.StatusBadRequest)
+			return
+		}
+
+		all, err := listProductNames()
+		if err != nil {
+			http.Error(w, "Failed to list products", http.StatusInternalServerError)
+			return
+		}
+		after := r.URL.Query().Get("after")
+		for _, name := range all {
+			if name > after {
+				names = append(names, name)
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	encoder := json.NewEncoder(gz)
+
+	sent := 0
+	for _, name := range names {
+		if owner != "" {
+			owners, err := ownersOf(ring, name, replicaCount())
+			if err != nil || !contains(owners, owner) {
+				continue
+			}
+		}
+
+		record, found, err := readRecord(name)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", name, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		// Writes block once the receiver stops reading, that is the flow control
+		if err := encoder.Encode(record); err != nil {
+			return
+		}
+
+		sent++
+		if sent%bulkBatchSize == 0 {
+			gz.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRecords(t *testing.T) {
+	records := []BulkRecord{
+		{
+			Product: common.Product{Name: "a", Price: 10, Version: common.Version{WallTime: 1, Node: "n"}},
+			History: []common.PricePoint{{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Price: 10}},
+		},
+		{Product: common.Product{Name: "b", Deleted: true, Version: common.Version{WallTime: 2, Node: "n"}}},
+	}
+
+	var body bytes.Buffer
+	if err := encodeRecords(&body, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []BulkRecord
+	err := decodeRecords(&body, func(record BulkRecord) error {
+		decoded = append(decoded, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 2 || decoded[0].Product.Name != "a" || len(decoded[0].History) != 1 || !decoded[1].Product.Deleted {
+		t.Fatalf("unexpected records %+v", decoded)
+	}
+}
+
+func TestBatchHandlerBusy(t *testing.T) {
+	previous := bulkSlots
+	defer func() { bulkSlots = previous }()
+
+	// Every slot is taken by batches being applied
+	bulkSlots = make(chan struct{}, 1)
+	bulkSlots <- struct{}{}
+
+	var body bytes.Buffer
+	encodeRecords(&body, nil)
+
+	recorder := httptest.NewRecorder()
+	batchHandler(recorder, httptest.NewRequest(http.MethodPost, "/replicate/batch", &body))
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected the sender to be told to retry, got %d", recorder.Code)
+	}
+}
+
+func TestBatchHandlerSkipsCorruptRecords(t *testing.T) {
+	addr = t.TempDir()
+
+	records := []BulkRecord{
+		{Product: common.Product{Name: "a", Checksum: "bad", Version: common.Version{WallTime: 1, Node: "n"}}},
+		{Product: common.Product{Name: "b", Checksum: "bad", Version: common.Version{WallTime: 1, Node: "n"}}},
+	}
+	var body bytes.Buffer
+	encodeRecords(&body, records)
+
+	recorder := httptest.NewRecorder()
+	batchHandler(recorder, httptest.NewRequest(http.MethodPost, "/replicate/batch", &body))
+
+	var result BatchResult
+	json.NewDecoder(recorder.Body).Decode(&result)
+	if recorder.Code != http.StatusOK || len(result.Skipped) != 2 || result.Applied != 0 {
+		t.Fatalf("expected both records to be skipped, got %d %+v", recorder.Code, result)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	common "commons"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many changes are kept, consumers that fall further behind have to start
+// over from a full gather
+const changeRetention = 50000
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+	maxChangesWait      = time.Minute
+)
+
+var (
+	changesMutex  sync.Mutex
+	changesLoaded bool
+	changesFile   *os.File
+	// Sequence numbers of the first and last retained changes
+	changesFirst uint64
+	changesLast  uint64
+	// Offset of every retained change in the file, the first one is changesFirst
+	changesOffsets []int64
+	changesSize    int64
+	// Closed and replaced every time a change is appended to wake up long polls
+	changesNotify = make(chan struct{})
+)
+
+func changesPath() string {
+	return filepath.Join(addr, "changes.log")
+}
+
+// loadChanges indexes the change log the first time it is used, the caller must
+// hold changesMutex
+func loadChanges() error {
+	if changesLoaded {
+		return nil
+	}
+
+	f, err := os.OpenFile(changesPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	changesFirst, changesLast, changesOffsets, changesSize = 1, 0, nil, 0
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		var change common.Change
+		if err := json.Unmarshal(line, &change); err != nil {
+			break
+		}
+
+		if len(changesOffsets) == 0 {
+			changesFirst = change.Seq
+		}
+		changesOffsets = append(changesOffsets, changesSize)
+		changesLast = change.Seq
+		changesSize += int64(len(line))
+	}
+
+	// A crash while appending leaves a partial last line behind
+	if err := f.Truncate(changesSize); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(changesSize, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	changesFile = f
+	changesLoaded = true
+	return nil
+}
+
+func changeOp(product common.Product, previous *common.Product) string {
+	switch {
+	case product.Deleted:
+		return common.ChangeDelete
+	case previous == nil || previous.Deleted:
+		return common.ChangeInsert
+	}
+	return common.ChangeUpdate
+}
+
+// newChange returns the change the write of a product makes, tombstones replacing
+// tombstones change nothing for consumers
+func newChange(product common.Product, previous *common.Product) (common.Change, bool) {
+	if product.Deleted && (previous == nil || previous.Deleted) {
+		return common.Change{}, false
+	}
+
+	change := common.Change{
+		Op:      changeOp(product, previous),
+		Key:     product.Name,
+		Version: product.Version,
+		Time:    time.Now().UTC(),
+	}
+	if !product.Deleted {
+		change.Product = &product
+	}
+	return change, true
+}
+
+// writeProductChange writes the product file and appends its change to the log
+// through the same write-ahead log operation. It is called by storeProduct while
+// holding storeMutex, so the log follows the order of the writes.
+func writeProductChange(fp string, data []byte, product common.Product, previous *common.Product) error {
+	change, ok := newChange(product, previous)
+	if !ok {
+		return walWrite(fp, data)
+	}
+
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
+	if err := loadChanges(); err != nil {
+		return err
+	}
+	// The changes of earlier writes take their sequence numbers first, one
+	// appended after them would be skipped as already there
+	if err := walFinishPending(); err != nil {
+		return err
+	}
+
+	change.Seq = changesLast + 1
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	return walWriteChange(fp, data, append(line, '\n'))
+}
+
+// appendChange appends an encoded change to the log unless it is already there,
+// so replaying it after a crash doesn't add it twice. The caller must hold
+// changesMutex.
+func appendChange(line []byte) error {
+	if err := loadChanges(); err != nil {
+		return err
+	}
+
+	var change common.Change
+	if err := json.Unmarshal(line, &change); err != nil {
+		return err
+	}
+	if change.Seq <= changesLast {
+		return nil
+	}
+
+	if _, err := changesFile.Write(line); err != nil {
+		return err
+	}
+	if err := changesFile.Sync(); err != nil {
+		return err
+	}
+
+	if len(changesOffsets) == 0 {
+		changesFirst = change.Seq
+	}
+	changesOffsets = append(changesOffsets, changesSize)
+	changesSize += int64(len(line))
+	changesLast = change.Seq
+
+	close(changesNotify)
+	changesNotify = make(chan struct{})
+
+	if len(changesOffsets) > changeRetention+changeRetention/10 {
+		if err := compactChanges(); err != nil {
+			log.Printf("Failed to compact the change log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// compactChanges drops the oldest changes beyond the retention, the caller must
+// hold changesMutex
+func compactChanges() error {
+	drop := len(changesOffsets) - changeRetention
+	start := changesOffsets[drop]
+
+	data := make([]byte, changesSize-start)
+	if _, err := changesFile.ReadAt(data, start); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(changesPath(), data); err != nil {
+		return err
+	}
+
+	changesFile.Close()
+	changesLoaded = false
+	return loadChanges()
+}
+
+// readChanges returns up to limit changes after the cursor, together with a
+// channel closed on the next append. It fails with errChangesGone when the
+// changes after the cursor are no longer retained.
+func readChanges(cursor uint64, limit int) ([]common.Change, <-chan struct{}, error) {
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
+	if err := loadChanges(); err != nil {
+		return nil, nil, err
+	}
+
+	// A cursor ahead of the log belongs to a log that was lost or restored. A
+	// cursor of 0 is gone too once the first changes were compacted, new
+	// consumers start from a gather then.
+	if cursor > changesLast || cursor+1 < changesFirst {
+		return nil, nil, errChangesGone
+	}
+	if cursor == changesLast {
+		return []common.Change{}, changesNotify, nil
+	}
+
+	index := 0
+	if cursor >= changesFirst {
+		index = int(cursor + 1 - changesFirst)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(changesFile, changesOffsets[index], changesSize-changesOffsets[index]))
+
+	changes := []common.Change{}
+	for len(changes) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var change common.Change
+		if err := json.Unmarshal(line, &change); err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, changesNotify, nil
+}
+
+var errChangesGone = errors.New("the changes after the cursor are no longer available")
+
+// lastChange is the sequence number of the newest change, a consumer that
+// gathers the products now can follow the feed from it
+func lastChange() uint64 {
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
+	if err := loadChanges(); err != nil {
+		return 0
+	}
+	return changesLast
+}
+
+// changesHandler streams the change log as NDJSON starting after the cursor. With
+// wait set it holds the request until there is at least one change, so consumers
+// can long-poll it. The cursor to resume from is in the X-Next-Cursor header. When
+// the changes after the cursor are gone it answers 410 with the cursor to follow
+// from after gathering the products again.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	var cursor uint64
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultChangesLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxChangesLimit {
+			limit = maxChangesLimit
+		}
+	}
+
+	var wait time.Duration
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		var err error
+		wait, err = time.ParseDuration(raw)
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		if wait > maxChangesWait {
+			wait = maxChangesWait
+		}
+	}
+
+	changes, notify, err := readChanges(cursor, limit)
+	if len(changes) == 0 && err == nil && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+			changes, _, err = readChanges(cursor, limit)
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+	if err == errChangesGone {
+		w.Header().Set("X-Next-Cursor", strconv.FormatUint(lastChange(), 10))
+		w.Header().Set("X-Node", addr)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read the change log: %v", err)
+		http.Error(w, "Failed to read the change log", http.StatusInternalServerError)
+		return
+	}
+
+	next := cursor
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Next-Cursor", strconv.FormatUint(next, 10))
+	w.Header().Set("X-Node", addr)
+
+	encoder := json.NewEncoder(w)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return
+		}
+	}
+}
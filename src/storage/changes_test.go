@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func resetChanges() {
+	if changesFile != nil {
+		changesFile.Close()
+	}
+	changesLoaded = false
+}
+
+func TestChangeLog(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer resetChanges()
+	resetChanges()
+
+	product := common.Product{Name: "product", Price: 10, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}}
+	storeProduct(product)
+
+	product.Price = 8
+	product.Version.WallTime = 2
+	storeProduct(product)
+
+	tombstone := common.Product{Name: "product", Deleted: true, Replicated: true, Version: common.Version{WallTime: 3, Node: "a"}}
+	storeProduct(tombstone)
+
+	changes, _, err := readChanges(0, 10)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v %v", changes, err)
+	}
+	for i, op := range []string{common.ChangeInsert, common.ChangeUpdate, common.ChangeDelete} {
+		if changes[i].Seq != uint64(i+1) || changes[i].Op != op {
+			t.Fatalf("unexpected change %d: %+v", i, changes[i])
+		}
+	}
+	if changes[1].Product == nil || changes[1].Product.Price != 8 || changes[2].Product != nil {
+		t.Fatalf("unexpected products in the changes %+v", changes)
+	}
+
+	// The log is indexed again from disk after a restart
+	resetChanges()
+	changes, _, err = readChanges(1, 1)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 2 {
+		t.Fatalf("expected to resume after the cursor, got %+v %v", changes, err)
+	}
+
+	if _, _, err := readChanges(10, 10); err != errChangesGone {
+		t.Fatalf("expected a cursor ahead of the log to be rejected, got %v", err)
+	}
+}
+
+func TestChangeReplayedWithProduct(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer resetChanges()
+	resetChanges()
+
+	// A crash after the product was written but before its change was appended
+	product := common.Product{Name: "product", Price: 10, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}}
+	data, _ := json.Marshal(product)
+	change, _ := json.Marshal(common.Change{Seq: 1, Op: common.ChangeInsert, Key: "product", Version: product.Version, Product: &product})
+	walSeq++
+	appendWAL(walRecord{Seq: walSeq, Op: walPut, State: walBegin, Path: productPath("product"), Data: data, Change: append(change, '\n')})
+	os.WriteFile(productPath("product"), data, 0644)
+	walFile.Close()
+	walFile = nil
+
+	recoverWAL()
+	// Replaying twice doesn't append the change twice
+	changesMutex.Lock()
+	appendChange(append(change, '\n'))
+	changesMutex.Unlock()
+
+	changes, _, err := readChanges(0, 10)
+	if err != nil || len(changes) != 1 || changes[0].Key != "product" {
+		t.Fatalf("expected the change to be replayed once, got %+v %v", changes, err)
+	}
+}
+
+func TestChangesFromStartAfterCompaction(t *testing.T) {
+	addr = t.TempDir()
+	defer resetChanges()
+	resetChanges()
+
+	// The first changes were compacted away
+	os.WriteFile(changesPath(), []byte(`{"seq":5,"op":"insert","key":"a"}`+"\n"), 0644)
+
+	if _, _, err := readChanges(0, 10); err != errChangesGone {
+		t.Fatalf("expected new consumers to be sent to a gather, got %v", err)
+	}
+	if changes, _, err := readChanges(4, 10); err != nil || len(changes) != 1 {
+		t.Fatalf("expected the retained changes, got %+v %v", changes, err)
+	}
+}
+
+func TestPendingChangeFinishedBeforeNextWrite(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer resetChanges()
+	resetChanges()
+
+	// The product was written but its change couldn't be appended
+	first := common.Product{Name: "a", Price: 10, Replicated: true, Version: common.Version{WallTime: 1, Node: "n"}}
+	data, _ := json.Marshal(first)
+	change, _ := json.Marshal(common.Change{Seq: 1, Op: common.ChangeInsert, Key: "a", Version: first.Version, Product: &first})
+	walSeq++
+	record := walRecord{Seq: walSeq, Op: walPut, State: walBegin, Path: productPath("a"), Data: data, Change: append(change, '\n')}
+	appendWAL(record)
+	os.WriteFile(productPath("a"), data, 0644)
+	walPending = []walRecord{record}
+	walCommitted = walCheckpointEvery
+
+	second := common.Product{Name: "b", Price: 12, Replicated: true, Version: common.Version{WallTime: 2, Node: "n"}}
+	data, _ = json.Marshal(second)
+	if err := writeProductChange(productPath("b"), data, second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, _, err := readChanges(0, 10)
+	if err != nil || len(changes) != 2 || changes[0].Key != "a" || changes[1].Key != "b" {
+		t.Fatalf("expected both changes in order, got %+v %v", changes, err)
+	}
+	// Only the operation of the second write is left in the log
+	wal, _ := os.ReadFile(walPath())
+	if len(walPending) != 0 || bytes.Contains(wal, []byte(productPath("a"))) {
+		t.Fatalf("expected the log to be truncated once nothing is pending, got %s", wal)
+	}
+}
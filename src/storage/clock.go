@@ -0,0 +1,41 @@
+package main
+
+import (
+	common "commons"
+	"sync"
+	"time"
+)
+
+// hybridClock hands out hybrid logical clock versions for the products this node
+// coordinates. Versions seen from other nodes are observed so a later insert here
+// always orders after anything we already stored.
+type hybridClock struct {
+	mu   sync.Mutex
+	node string
+	last common.Version
+}
+
+var clock = &hybridClock{}
+
+func (c *hybridClock) Now() common.Version {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := time.Now().UnixMilli()
+	if wall > c.last.WallTime {
+		c.last = common.Version{WallTime: wall, Logical: 0, Node: c.node}
+	} else {
+		c.last = common.Version{WallTime: c.last.WallTime, Logical: c.last.Logical + 1, Node: c.node}
+	}
+
+	return c.last
+}
+
+func (c *hybridClock) Observe(remote common.Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if remote.WallTime > c.last.WallTime || (remote.WallTime == c.last.WallTime && remote.Logical > c.last.Logical) {
+		c.last = common.Version{WallTime: remote.WallTime, Logical: remote.Logical, Node: c.node}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	common "commons"
+	"testing"
+	"time"
+)
+
+func TestClockMonotonic(t *testing.T) {
+	c := &hybridClock{node: "a"}
+
+	prev := c.Now()
+	for i := 0; i < 1000; i++ {
+		next := c.Now()
+		if next.Compare(prev) <= 0 {
+			t.Fatalf("version went backwards: %s after %s", next, prev)
+		}
+		prev = next
+	}
+}
+
+func TestClockObserve(t *testing.T) {
+	c := &hybridClock{node: "a"}
+
+	remote := common.Version{WallTime: time.Now().Add(time.Hour).UnixMilli(), Logical: 7, Node: "b"}
+	c.Observe(remote)
+
+	if v := c.Now(); v.Compare(remote) <= 0 {
+		t.Fatalf("expected %s to be newer than %s", v, remote)
+	}
+}
+
+func TestVersionTieBreak(t *testing.T) {
+	a := common.Version{WallTime: 10, Logical: 1, Node: "a"}
+	b := common.Version{WallTime: 10, Logical: 1, Node: "b"}
+
+	if a.Compare(b) != -1 || b.Compare(a) != 1 {
+		t.Fatalf("expected node to break ties")
+	}
+	if a.Compare(a) != 0 {
+		t.Fatalf("expected equal versions")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8), used by the cold tier. The data is
+// split into k shards and m parity shards are computed from them, any k of the
+// k+m shards are enough to rebuild the data.
+
+// Exponentials and logarithms of the generator 2 with the polynomial
+// x^8+x^4+x^3+x^2+1. The exponentials are doubled so products don't wrap.
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// Addition and subtraction are both xor in GF(2^8)
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv expects b not to be 0
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newMatrix(rows int, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+// vandermonde builds the matrix whose row r is 1, r, r^2... Any cols of its rows
+// are linearly independent.
+func vandermonde(rows int, cols int) gfMatrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfPow(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m gfMatrix) multiply(o gfMatrix) gfMatrix {
+	result := newMatrix(len(m), len(o[0]))
+	for r := range result {
+		for c := range result[r] {
+			var value byte
+			for i := range o {
+				value ^= gfMul(m[r][i], o[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+	return result
+}
+
+// selectRows returns the matrix made of the given rows
+func (m gfMatrix) selectRows(rows []int) gfMatrix {
+	result := make(gfMatrix, len(rows))
+	for i, r := range rows {
+		result[i] = append([]byte(nil), m[r]...)
+	}
+	return result
+}
+
+var errSingularMatrix = errors.New("matrix is singular")
+
+// invert inverts a square matrix with Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	size := len(m)
+	work := newMatrix(size, 2*size)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		pivot := c
+		for pivot < size && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, errSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := work[c][c]
+		for i := range work[c] {
+			work[c][i] = gfDiv(work[c][i], scale)
+		}
+
+		for r := 0; r < size; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(factor, work[c][i])
+			}
+		}
+	}
+
+	inverse := newMatrix(size, size)
+	for r := range inverse {
+		copy(inverse[r], work[r][size:])
+	}
+	return inverse, nil
+}
+
+// reedSolomon encodes with a systematic matrix, the first rows are the identity so
+// the data shards are the data itself and the rest of the rows compute the parity
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	matrix       gfMatrix
+}
+
+var errTooFewShards = errors.New("too few shards to reconstruct the data")
+
+func newReedSolomon(dataShards int, parityShards int) (*reedSolomon, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid number of shards: %d data and %d parity", dataShards, parityShards)
+	}
+
+	v := vandermonde(dataShards+parityShards, dataShards)
+	top := make([]int, dataShards)
+	for i := range top {
+		top[i] = i
+	}
+	inverse, err := v.selectRows(top).invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       v.multiply(inverse),
+	}, nil
+}
+
+func (rs *reedSolomon) totalShards() int {
+	return rs.dataShards + rs.parityShards
+}
+
+// split pads the data to fill the data shards evenly and allocates the parity
+// shards, which are computed by encode
+func (rs *reedSolomon) split(data []byte) [][]byte {
+	size := (len(data) + rs.dataShards - 1) / rs.dataShards
+	if size == 0 {
+		size = 1
+	}
+
+	padded := make([]byte, size*rs.dataShards)
+	copy(padded, data)
+
+	shards := make([][]byte, rs.totalShards())
+	for i := 0; i < rs.dataShards; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	for i := rs.dataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+	}
+	return shards
+}
+
+// codeShard computes out as the combination of the inputs with the coefficients
+func codeShard(coefficients []byte, inputs [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for j, input := range inputs {
+		c := coefficients[j]
+		if c == 0 {
+			continue
+		}
+		for i := range out {
+			out[i] ^= gfMul(c, input[i])
+		}
+	}
+}
+
+// encode fills the parity shards from the data shards
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := rs.dataShards; p < rs.totalShards(); p++ {
+		codeShard(rs.matrix[p], shards[:rs.dataShards], shards[p])
+	}
+}
+
+// reconstruct rebuilds the missing shards, the ones that are nil, as long as at
+// least dataShards of them are present
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	if len(shards) != rs.totalShards() {
+		return fmt.Errorf("expected %d shards, got %d", rs.totalShards(), len(shards))
+	}
+
+	var present []int
+	size := 0
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size == 0 {
+			size = len(shard)
+		}
+		if len(shard) != size {
+			return fmt.Errorf("shard %d has %d bytes instead of %d", i, len(shard), size)
+		}
+		present = append(present, i)
+	}
+	if len(present) < rs.dataShards {
+		return errTooFewShards
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+
+	// The rows of the present shards map the data to them, their inverse maps
+	// them back to the data
+	present = present[:rs.dataShards]
+	decode, err := rs.matrix.selectRows(present).invert()
+	if err != nil {
+		return err
+	}
+
+	inputs := make([][]byte, len(present))
+	for i, index := range present {
+		inputs[i] = shards[index]
+	}
+	for d := 0; d < rs.dataShards; d++ {
+		if shards[d] == nil {
+			shards[d] = make([]byte, size)
+			codeShard(decode[d], inputs, shards[d])
+		}
+	}
+
+	for p := rs.dataShards; p < rs.totalShards(); p++ {
+		if shards[p] == nil {
+			shards[p] = make([]byte, size)
+			codeShard(rs.matrix[p], shards[:rs.dataShards], shards[p])
+		}
+	}
+	return nil
+}
+
+// join puts the data shards back together without the padding
+func (rs *reedSolomon) join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for i := 0; i < rs.dataShards && len(data) < size; i++ {
+		if shards[i] == nil {
+			return nil, errTooFewShards
+		}
+		data = append(data, shards[i]...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`[{"time":"2024-01-01T00:00:00Z","price":199.99,"rating":"4.5","available":true}]`)
+	shards := rs.split(data)
+	rs.encode(shards)
+
+	// Any two shards can be lost
+	for a := 0; a < rs.totalShards(); a++ {
+		for b := a + 1; b < rs.totalShards(); b++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+
+			if err := rs.reconstruct(damaged); err != nil {
+				t.Fatalf("failed without shards %d and %d: %v", a, b, err)
+			}
+			joined, err := rs.join(damaged, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(joined, data) {
+				t.Fatalf("unexpected data without shards %d and %d: %s", a, b, joined)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("shard %d was rebuilt wrong without shards %d and %d", i, a, b)
+				}
+			}
+		}
+	}
+}
+
+func TestReedSolomonTooFewShards(t *testing.T) {
+	rs, err := newReedSolomon(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := rs.split([]byte("price history"))
+	rs.encode(shards)
+	shards[0], shards[2] = nil, nil
+
+	if err := rs.reconstruct(shards); err != errTooFewShards {
+		t.Fatalf("expected errTooFewShards, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	common "commons"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Most products a cluster export answers when no limit is given, the scatter
+// keeps them in memory
+const maxExportProducts = 1000000
+
+// exportHandler exports products as csv, tsv, ndjson or pretty printed json with
+// the columns given as columns=name,price,... The filters of /query narrow what is
+// exported. The whole cluster is exported unless scope=local is given, which
+// streams the copies stored in this node.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = common.ExportCSV
+	}
+	if !common.ValidExportFormat(format) {
+		http.Error(w, fmt.Sprintf("unknown format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	columns, err := common.ParseExportColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("limit") == "" {
+		q.Limit = maxExportProducts
+	}
+
+	w.Header().Set("Content-Type", common.ExportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"products.%s\"", format))
+
+	exporter, err := common.NewExporter(w, format, columns)
+	if err != nil {
+		return
+	}
+	defer exporter.Close()
+
+	if r.URL.Query().Get("scope") == "local" {
+		count := 0
+		err := scanProducts("", func(product common.Product) bool {
+			if !q.matches(product) {
+				return true
+			}
+			if err := exporter.Write(product); err != nil {
+				return false
+			}
+			count++
+			return count < q.Limit
+		})
+		if err != nil {
+			log.Printf("Failed to export the local products: %v", err)
+		}
+		return
+	}
+
+	for _, product := range scatterQuery(q) {
+		if err := exporter.Write(product); err != nil {
+			return
+		}
+	}
+}
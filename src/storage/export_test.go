@@ -0,0 +1,59 @@
+package main
+
+import (
+	common "commons"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportHandlerEscapes(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	product := common.Product{
+		Name:        "Monitor",
+		Price:       199.5,
+		Description: "27\"\tIPS,\nlow latency",
+		Replicated:  true,
+		Version:     common.Version{WallTime: 1, Node: "a"},
+	}
+	if _, err := storeProduct(product); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	exportHandler(recorder, httptest.NewRequest("GET", "/export?scope=local&format=csv&columns=name,price,description", nil))
+
+	records, err := csv.NewReader(strings.NewReader(recorder.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid csv %q: %v", recorder.Body.String(), err)
+	}
+	if len(records) != 2 || records[1][0] != "Monitor" || records[1][1] != "199.5" || records[1][2] != product.Description {
+		t.Fatalf("unexpected records %q", records)
+	}
+
+	recorder = httptest.NewRecorder()
+	exportHandler(recorder, httptest.NewRequest("GET", "/export?scope=local&format=tsv&columns=description", nil))
+	if lines := strings.Split(strings.TrimSuffix(recorder.Body.String(), "\n"), "\n"); len(lines) != 2 || strings.Contains(lines[1], "\t") {
+		t.Fatalf("unexpected tsv %q", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	exportHandler(recorder, httptest.NewRequest("GET", "/export?scope=local&format=json&columns=price,name", nil))
+	var exported []map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &exported); err != nil || len(exported) != 1 || exported[0]["price"] != 199.5 {
+		t.Fatalf("unexpected json %s: %v", recorder.Body.String(), err)
+	}
+	if !strings.HasPrefix(recorder.Body.String(), "[\n  {\n    \"price\"") {
+		t.Fatalf("columns out of order %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	exportHandler(recorder, httptest.NewRequest("GET", "/export?columns=nope", nil))
+	if recorder.Code != 400 {
+		t.Fatalf("expected an unknown column to be rejected, got %d", recorder.Code)
+	}
+}
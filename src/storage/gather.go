@@ -0,0 +1,120 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// scanProducts calls fn with every local product whose key comes after cursor, in
+// key order, until fn returns false. Products are read one at a time so the whole
+// directory is never held in memory.
+func scanProducts(cursor string, fn func(product common.Product) bool) error {
+	names, err := listProductNames()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names[sort.SearchStrings(names, cursor):] {
+		if name == cursor {
+			continue
+		}
+
+		product, found, err := readProduct(name)
+		if err != nil {
+			// The scrubber repairs it from a replica
+			log.Printf("Skipping unreadable product %s: %v", name, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		if product.Deleted {
+			continue // Tombstones are only meant for replicas
+		}
+
+		if !fn(product) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// gatherHandler returns the products stored in this node. Without a limit it
+// answers every product, otherwise it answers a page and the cursor of the next
+// one in the X-Next-Cursor header. With format=ndjson the products are streamed
+// one per line and the cursor is sent as a trailer.
+func gatherHandler(w http.ResponseWriter, r *http.Request) {
+	cursor := r.URL.Query().Get("cursor")
+	ndjson := r.URL.Query().Get("format") == "ndjson"
+
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Trailer", "X-Next-Cursor")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	products := []common.Product{}
+	count := 0
+	last := ""
+	next := ""
+
+	err := scanProducts(cursor, func(product common.Product) bool {
+		if limit > 0 && count == limit {
+			// There is at least one more product, the page ends here
+			next = last
+			return false
+		}
+		count++
+		last = product.Name
+
+		if !ndjson {
+			products = append(products, product)
+			return true
+		}
+
+		if err := encoder.Encode(product); err != nil {
+			return false
+		}
+		if flusher != nil && count%100 == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	if ndjson {
+		w.Header().Set("X-Next-Cursor", next)
+		return
+	}
+
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	// Grouping here only sees the products of this node, the client groups the
+	// products of the whole cluster
+	writeProducts(w, r, products)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"chord"
+	common "commons"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Hint is a write a replica missed while it was unreachable. The coordinator keeps
+// it on disk and hands it off once the replica is back.
+type Hint struct {
+	Target  string              `json:"target"`
+	Product common.Product      `json:"product"`
+	Points  []common.PricePoint `json:"points"`
+	Created time.Time           `json:"created"`
+}
+
+var hintsMutex sync.Mutex
+
+func hintsDir() string {
+	return filepath.Join(addr, "hints")
+}
+
+func hintPath(target string, name string) string {
+	return filepath.Join(hintsDir(), target, keyFile(name))
+}
+
+// storeHint durably records a write for target. A newer hint for the same product
+// replaces the previous one since only the latest version matters.
+func storeHint(target string, product common.Product, points []common.PricePoint) error {
+	hintsMutex.Lock()
+	defer hintsMutex.Unlock()
+
+	fp := hintPath(target, product.Name)
+
+	// Keep the points of the hint we are replacing
+	if data, err := os.ReadFile(fp); err == nil {
+		var previous Hint
+		if json.Unmarshal(data, &previous) == nil {
+			if previous.Product.Version.Compare(product.Version) > 0 {
+				product = previous.Product
+			}
+			points = append(previous.Points, points...)
+		}
+	}
+
+	hint := Hint{Target: target, Product: product, Points: points, Created: time.Now()}
+	data, err := json.MarshalIndent(hint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The hint is the only copy the replica will get, make sure it hits the disk
+	return walWrite(fp, data)
+}
+
+// isReachable pings one of the vnodes of the host through the chord transport
+func isReachable(ring *chord.Ring, host string) bool {
+	vnodes, err := ring.Transport.ListVnodes(host)
+	if err != nil || len(vnodes) == 0 {
+		return false
+	}
+
+	ok, err := ring.Transport.Ping(vnodes[0])
+	return err == nil && ok
+}
+
+// replayHints hands off the stored hints of every replica that answers pings again
+func replayHints(ring *chord.Ring) {
+	targets, err := os.ReadDir(hintsDir())
+	if err != nil {
+		return
+	}
+
+	for _, target := range targets {
+		if !target.IsDir() {
+			continue
+		}
+
+		host := target.Name()
+		if !isReachable(ring, host) {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(hintsDir(), host))
+		if err != nil {
+			log.Printf("Failed to read hints for %s: %v", host, err)
+			continue
+		}
+
+		for _, file := range files {
+			if err := replayHint(filepath.Join(hintsDir(), host, file.Name())); err != nil {
+				log.Printf("Failed to hand off hint %s to %s: %v", file.Name(), host, err)
+				break
+			}
+		}
+
+		// Remove the directory once every hint was handed off
+		os.Remove(filepath.Join(hintsDir(), host))
+	}
+}
+
+func replayHint(fp string) error {
+	hintsMutex.Lock()
+	defer hintsMutex.Unlock()
+
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+
+	var hint Hint
+	if err := json.Unmarshal(data, &hint); err != nil {
+		// Nothing can be done with a broken hint
+		log.Printf("Discarding unreadable hint %s: %v", fp, err)
+		return walRemove(fp)
+	}
+
+	if err := SendProductRequest(hint.Product, httpAddress(hint.Target)); err != nil {
+		return err
+	}
+
+	if len(hint.Points) > 0 {
+		if err := SendHistoryRequest(hint.Product.Name, hint.Points, httpAddress(hint.Target)); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Handed off hint for %s to %s", hint.Product.Name, hint.Target)
+
+	return walRemove(fp)
+}
+
+func HintedHandoff(ring *chord.Ring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		replayHints(ring)
+	}
+}
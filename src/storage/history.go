@@ -0,0 +1,153 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var historyMutex sync.Mutex
+
+func historyDir() string {
+	return filepath.Join(addr, "history")
+}
+
+func historyPath(name string) string {
+	return filepath.Join(historyDir(), keyFile(name))
+}
+
+// newPricePoint takes a snapshot of the fields we track over time. When the
+// scrapper couldn't tell the availability, a product is considered available if
+// the scrape was able to find a price for it.
+func newPricePoint(product common.Product, at time.Time) common.PricePoint {
+	available := product.Availability == common.InStock
+	if product.Availability == "" || product.Availability == common.UnknownAvailability {
+		available = product.Price > 0
+	}
+
+	return common.PricePoint{
+		Time:      at.UTC(),
+		Price:     product.Price,
+		Rating:    product.Rating,
+		Available: available,
+	}
+}
+
+func readHistory(name string) ([]common.PricePoint, error) {
+	data, err := os.ReadFile(historyPath(name))
+	if os.IsNotExist(err) {
+		return []common.PricePoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var points []common.PricePoint
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// mergeHistory adds the given points to the history of the product, ignoring the
+// ones already present so replicas can send the same points more than once
+func mergeHistory(name string, points []common.PricePoint) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	current, err := readHistory(name)
+	if err != nil {
+		return err
+	}
+
+	// Points already moved to the cold tier may still come from replicas that
+	// didn't learn about it yet
+	archived := archivedFilter(name)
+
+	seen := make(map[int64]bool)
+	for _, point := range current {
+		seen[point.Time.UnixNano()] = true
+	}
+
+	changed := false
+	for _, point := range points {
+		if seen[point.Time.UnixNano()] || archived(point.Time) {
+			continue
+		}
+		seen[point.Time.UnixNano()] = true
+		current = append(current, point)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	sort.Slice(current, func(i, j int) bool {
+		return current[i].Time.Before(current[j].Time)
+	})
+
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return walWrite(historyPath(name), data)
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		points, err := readHistory(key)
+		if err != nil {
+			http.Error(w, "Failed to read history", http.StatusInternalServerError)
+			return
+		}
+
+		// The local scope only has the hot points, it is what replicas exchange
+		if r.URL.Query().Get("scope") != "local" {
+			archived, err := readArchivedHistory(key)
+			if err != nil {
+				log.Printf("Failed to read the archived history of %s: %v", key, err)
+				http.Error(w, "Archived history unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			points = mergePoints(archived, points)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(points); err != nil {
+			http.Error(w, "Failed to encode history", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		// Replicas send us the points they have so we can merge them with ours
+		var points []common.PricePoint
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if err := mergeHistory(key, points); err != nil {
+			log.Printf("Failed to merge history of %s: %v", key, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
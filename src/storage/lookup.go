@@ -1,65 +1,91 @@
 package main
 
 import (
+	"bytes"
 	"chord"
 	common "commons"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func insertInStore(ring *chord.Ring, product common.Product, host string, amount int) {
+// insertInStore sends the product to its replicas in parallel and returns how
+// many of them acknowledged the write
+func insertInStore(ring *chord.Ring, product common.Product, host string, amount int) int {
 	key := []byte(product.Name)
 	successors := lookupKey(ring, key, host, amount)
 
-	for _, closestAddr := range successors {
+	// Every insertion is a new observation of the product, all the replicas keep it
+	point := newPricePoint(product, time.Now())
+
+	var acks int32
+	var wg sync.WaitGroup
+
+	for i, closestAddr := range successors {
 
 		ip := strings.Split(closestAddr, ":")[0]
 		port := strings.Split(closestAddr, ":")[1]
 		intPort, err := strconv.Atoi(port)
 		if err != nil {
 			fmt.Printf("Error while converting port to int: %s", err)
-			return
+			continue
 		}
 
-		product.Replicated = true
-		err = SendProductRequest(product, ip+":"+strconv.Itoa(intPort+1))
-		if err != nil {
-			fmt.Printf("Error while sending the insertion request for %s: %s", product.Name, err)
-		}
+		// The first successor is the primary owner, the rest hold replicas
+		replica := product
+		replica.Replicated = i != 0
+
+		wg.Add(1)
+		go func(target string, address string) {
+			points := []common.PricePoint{point}
+			if replica.Deleted {
+				// Tombstones are not observations of the product
+				points = nil
+			}
+
+			defer wg.Done()
+
+			err := SendProductRequest(replica, address)
+			if err != nil {
+				fmt.Printf("Error while sending the insertion request for %s: %s", replica.Name, err)
+
+				// Keep the write around until the replica is back
+				if err := storeHint(target, replica, points); err != nil {
+					log.Printf("Failed to store hint for %s: %v", target, err)
+				}
+				return
+			}
+			atomic.AddInt32(&acks, 1)
+
+			if len(points) == 0 {
+				return
+			}
+
+			err = SendHistoryRequest(replica.Name, points, address)
+			if err != nil {
+				fmt.Printf("Error while sending the history of %s: %s", replica.Name, err)
+			}
+		}(closestAddr, ip+":"+strconv.Itoa(intPort+1))
 	}
 
+	wg.Wait()
+
+	return int(atomic.LoadInt32(&acks))
 }
 
 // Function to look for a key in the ring
 func lookupKey(ring *chord.Ring, key []byte, host string, amount int) []string {
-	successors, err := ring.Lookup(8, key) // Request 8 successors
+	result, err := ownersOf(ring, string(key), amount)
 	if err != nil {
 		log.Fatalf("Lookup failed: %v", err)
 	}
 
-	uniqueSuccessors := make(map[string]bool)
-	var result []string
-
-	for _, succ := range successors {
-		// Print them
-		log.Printf("Successor for key %s: %s", string(key), succ.Host)
-	}
-
-	for _, succ := range successors {
-		if !uniqueSuccessors[succ.Host] {
-			uniqueSuccessors[succ.Host] = true
-			result = append(result, succ.Host)
-		}
-		if len(result) == amount {
-			break
-		}
-	}
-
 	if len(result) == 0 {
 		log.Fatalf("No unique successors found")
 	}
@@ -76,6 +102,92 @@ func lookupKey(ring *chord.Ring, key []byte, host string, amount int) []string {
 	return result // Return the first unique successor
 }
 
+// lookupWidth is how many successors are asked for when looking for the owners of
+// a key. Vnodes of hosts already found are skipped, so it is as many as the ring
+// keeps, which also bounds the replication factor.
+func lookupWidth(ring *chord.Ring) int {
+	return ring.Config.NumSuccessors
+}
+
+// ownersOf returns up to amount unique hosts responsible for the key, the first
+// one being the primary owner. The replicas are spread across the zones the
+// successors advertise, see placeReplicas. It makes no request besides the lookup.
+func ownersOf(ring *chord.Ring, key string, amount int) ([]string, error) {
+	successors, err := ring.Lookup(lookupWidth(ring), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, zones := successorHosts(successors)
+	return placeReplicas(hosts, amount, func(host string) string { return zones[host] }), nil
+}
+
+// primaryOwners returns the primary owner of every key, the host of its first
+// successor. There is one lookup per range instead of one per key, see walkRanges.
+func primaryOwners(ring *chord.Ring, keys []string) map[string]string {
+	owners := make(map[string]string, len(keys))
+	walkRanges(ring, keys, 1, func(key string, successors []*chord.Vnode) {
+		owners[key] = successors[0].Host
+	})
+	return owners
+}
+
+// rangeOwners returns the owners of every key like ownersOf does, with one lookup
+// per range instead of one per key
+func rangeOwners(ring *chord.Ring, keys []string, amount int) map[string][]string {
+	owners := make(map[string][]string, len(keys))
+	walkRanges(ring, keys, lookupWidth(ring), func(key string, successors []*chord.Vnode) {
+		hosts, zones := successorHosts(successors)
+		owners[key] = placeReplicas(hosts, amount, func(host string) string { return zones[host] })
+	})
+	return owners
+}
+
+// walkRanges hands the successors of every key to visit. The keys are walked in
+// hash order and a lookup is only made when a key falls past the vnode found for
+// the previous one, the keys of a range share their successors. Keys whose lookup
+// failed are left out.
+func walkRanges(ring *chord.Ring, keys []string, n int, visit func(string, []*chord.Vnode)) {
+	type hashedKey struct {
+		key  string
+		hash []byte
+	}
+
+	hashed := make([]hashedKey, 0, len(keys))
+	for _, key := range keys {
+		h := ring.Config.HashFunc()
+		h.Write([]byte(key))
+		hashed = append(hashed, hashedKey{key: key, hash: h.Sum(nil)})
+	}
+	sort.Slice(hashed, func(i, j int) bool {
+		return bytes.Compare(hashed[i].hash, hashed[j].hash) < 0
+	})
+
+	var successors []*chord.Vnode
+	var from []byte
+	for _, entry := range hashed {
+		if successors == nil || !sameSuccessor(from, successors[0].Id, entry.hash) {
+			found, err := ring.LookupHash(n, entry.hash)
+			if err != nil || len(found) == 0 {
+				log.Printf("Lookup failed for %s: %v", entry.key, err)
+				successors = nil
+				continue
+			}
+			successors, from = found, entry.hash
+		}
+		visit(entry.key, successors)
+	}
+}
+
+// sameSuccessor tells if a hash at or after from has the successor id found for
+// from. When the successor wrapped around the ring every later hash has it too.
+func sameSuccessor(from []byte, id []byte, hash []byte) bool {
+	if bytes.Compare(from, id) > 0 {
+		return true
+	}
+	return bytes.Compare(hash, id) <= 0
+}
+
 func contains(a []string, v string) bool {
 	for _, b := range a {
 		if b == v {
@@ -86,9 +198,7 @@ func contains(a []string, v string) bool {
 }
 
 func write(product common.Product) {
-	// Generate a filename based on the current timestamp
-	filename := fmt.Sprintf("%s.json", product.Name)
-	fp := filepath.Join(addr, filename)
+	fp := productPath(product.Name)
 
 	// Convert the product to JSON
 	data, err := json.MarshalIndent(product, "", "  ")
@@ -98,12 +208,12 @@ func write(product common.Product) {
 	}
 
 	// Write the JSON content to the file
-	err = os.WriteFile(fp, data, 0644)
+	err = walWrite(fp, data)
 	if err != nil {
 		log.Printf("Failed to write file: %v", err)
 		return
 	}
 
 	// Respond to the client
-	log.Printf("File replicated successfully: %s\n", filename)
+	log.Printf("File replicated successfully: %s\n", fp)
 }
@@ -6,11 +6,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -48,7 +46,20 @@ func ServeChordWrapper(conf *chord.Config, trans chord.Transport, address string
 		}
 	}
 
+	if bootstrap != "" {
+		// A new node catches up in bulk instead of waiting for anti-entropy
+		go bootstrapNode(ring)
+	}
+
 	go ReplicateData(context.Background(), ring, addr, 5*time.Second)
+	go HintedHandoff(ring, 5*time.Second)
+	go CollectTombstones(time.Minute)
+	go Scrub(ring, time.Minute)
+	go WatchSync(ring, 30*time.Second)
+	go ReplicationSync(ring, 30*time.Second)
+	if archiveAfter > 0 {
+		go Archive(ring, 10*time.Minute)
+	}
 
 }
 
@@ -65,8 +76,15 @@ func mainWrapper(group *sync.WaitGroup) {
 	address += ":" + strconv.Itoa(port)
 
 	addr = address
+	clock.node = address
+	loadQuorumConfig()
+	loadTombstoneConfig()
+	loadZoneConfig()
+	loadArchiveConfig()
+	loadBulkConfig()
 	//node1 := node.NewChordNode(address, CustomPut)
 	config := chord.DefaultConfig(address)
+	config.Meta = map[string]string{zoneMeta: zone}
 	transport, err := chord.InitTCPTransport(address, 4*time.Second)
 
 	if err != nil {
@@ -79,6 +97,23 @@ func mainWrapper(group *sync.WaitGroup) {
 		log.Printf("Error creating directory: %v", err)
 	}
 
+	// Finish or discard the writes a crash interrupted before serving anything
+	recoverWAL()
+
+	// Seed the node from a snapshot before it joins the ring. A node that already
+	// has data keeps it, anti-entropy brings it up to date.
+	if snapshot := os.Getenv("RESTORE_SNAPSHOT"); snapshot != "" {
+		err := restoreSnapshot(snapshot)
+		if err == errDataNotEmpty {
+			log.Printf("Not restoring snapshot %s: %v", snapshot, err)
+		} else if err != nil {
+			log.Fatalf("Failed to restore snapshot %s: %v", snapshot, err)
+		}
+	}
+	migrateProductFiles()
+	migrateIndexFiles()
+	loadReplicationConfig()
+
 	found_ip := ""
 	found_port := 0
 
@@ -117,9 +152,11 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	response := struct {
 		Status string `json:"status"`
 		Time   string `json:"time"`
+		Zone   string `json:"zone,omitempty"`
 	}{
 		Status: "healthy",
 		Time:   time.Now().Format(time.RFC3339),
+		Zone:   zone,
 	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -138,78 +175,55 @@ func replicateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
-
-	// Generate a filename based on the current timestamp
-	filename := fmt.Sprintf("%s.json", payload.Name)
-	fp := filepath.Join(addr, filename)
-
-	if _, err := os.Stat(fp); err == nil {
-		// File exists, return "Ok" to the client
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "Already Replicated: Ok")
+	// Reject copies damaged on the way
+	if !common.VerifyChecksum(payload) {
+		http.Error(w, "Checksum mismatch", http.StatusBadRequest)
 		return
 	}
 
-	// Convert the payload to JSON
-	data, err := json.MarshalIndent(payload, "", "  ")
+	// Keep our clock ahead of every version we have seen
+	clock.Observe(payload.Version)
+
+	// Only overwrite the local copy if the payload is newer
+	written, err := storeProduct(payload)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Write the JSON content to the file
-	err = os.WriteFile(fp, data, 0644)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if !written {
+		// Our copy is at least as new, return "Ok" to the client
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Already Replicated: Ok")
 		return
 	}
 
 	// Respond to the client
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "File replicated successfully: %s\n", filename)
-	log.Printf("File replicated successfully: %s\n", filename)
+	fmt.Fprintf(w, "File replicated successfully: %s version %s\n", payload.Name, payload.Version)
+	log.Printf("File replicated successfully: %s version %s\n", payload.Name, payload.Version)
 }
 
-func gatherHandler(w http.ResponseWriter, r *http.Request) {
-	//// Only allow GET method
-	//if r.Method != http.MethodGet {
-	//	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	//	return
-	//}
+func fetchHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
 
-	// Read directory
-	files, err := ioutil.ReadDir(addr)
+	// Only look at the local copy
+	product, found, err := readProduct(key)
 	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		http.Error(w, "Failed to read product", http.StatusInternalServerError)
 		return
 	}
-
-	var products []common.Product
-
-	// Iterate over files
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			// Open and decode JSON
-			fp := filepath.Join(addr, file.Name())
-			data, err := os.ReadFile(fp)
-			if err != nil {
-				continue // Skip files that can't be read
-			}
-
-			var product common.Product
-			if err := json.Unmarshal(data, &product); err != nil {
-				continue // Skip files that can't be decoded
-			}
-
-			products = append(products, product)
-		}
+	if !found {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
 	}
 
-	// Respond with JSON
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(products); err != nil {
-		http.Error(w, "Failed to encode products", http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(product)
 }
 
 func insertHandler(w http.ResponseWriter, r *http.Request) {
@@ -226,13 +240,64 @@ func insertHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !validKey(payload.Name) {
+		http.Error(w, "Invalid product name", http.StatusBadRequest)
+		return
+	}
+
+	// This node coordinates the write, so it decides the version
+	payload.Version = clock.Now()
+	// Scrappers running an older version may send the old layout, the rest of
+	// the fields are derived from the ones they sent
+	payload = common.NormalizeProduct(common.UpgradeProduct(payload))
+	if payload.ScrapedAt.IsZero() {
+		payload.ScrapedAt = time.Now().UTC()
+	}
+	payload.Checksum = common.ProductChecksum(payload)
+
+	// The version the price alerts compare against, a copy that can't be read
+	// now raises no alerts rather than raising them twice. Without rules there
+	// is nothing to compare, so the write doesn't wait for the read.
+	watching := len(activeWatches()) > 0
+	var previous common.Product
+	var found bool
+	var readErr error
+	if watching {
+		previous, found, readErr = quorumRead(payload.Name)
+		if readErr != nil {
+			log.Printf("No price alerts for %s, the previous version can't be read: %v", payload.Name, readErr)
+		}
+	}
 
-	insertInStore(ring, payload, addr, 3)
+	acks := insertInStore(ring, payload, addr, replicaCount())
+
+	// The write is only durable once W replicas acknowledged it
+	if acks < writeQuorum() {
+		http.Error(w, fmt.Sprintf("Write quorum not reached: %d/%d acknowledgements", acks, writeQuorum()), http.StatusServiceUnavailable)
+		return
+	}
+
+	if watching && readErr == nil {
+		if found {
+			go evaluateWatches(payload, &previous)
+		} else {
+			go evaluateWatches(payload, nil)
+		}
+	}
 
 	// Respond to the client
-	w.WriteHeader(http.StatusOK)
-	//fmt.Fprintf(w, "File replicated successfully: %s\n", filename)
-	//log.Printf("File replicated successfully: %s\n", filename)
+	response := struct {
+		Key     string         `json:"key"`
+		Version common.Version `json:"version"`
+		Acks    int            `json:"acks"`
+	}{
+		Key:     payload.Name,
+		Version: payload.Version,
+		Acks:    acks,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 func setupServer(address string) *http.Server {
@@ -241,6 +306,33 @@ func setupServer(address string) *http.Server {
 	mux.HandleFunc("/healthcheck", healthCheckHandler)
 	mux.HandleFunc("/replicate", replicateHandler)
 	mux.HandleFunc("/gather", gatherHandler)
+	mux.HandleFunc("/history", historyHandler)
+	mux.HandleFunc("/fetch", fetchHandler)
+	mux.HandleFunc("/get", getHandler)
+	// Kept for the clients using it, reads follow the same quorum as /get
+	mux.HandleFunc("/product", getHandler)
+	mux.HandleFunc("/query", queryHandler)
+	mux.HandleFunc("/indexes", indexesHandler)
+	mux.HandleFunc("/offers", offersHandler)
+	mux.HandleFunc("/export", exportHandler)
+	mux.HandleFunc("/watch", watchHandler)
+	mux.HandleFunc("/changes", changesHandler)
+	mux.HandleFunc("/admin/replication", replicationHandler)
+	mux.HandleFunc("/admin/replication/apply", replicationApplyHandler)
+	mux.HandleFunc("/admin/ownership", ownershipHandler)
+	mux.HandleFunc("/admin/placement", keyPlacementHandler)
+	mux.HandleFunc("/admin/keys", adminKeysHandler)
+	mux.HandleFunc("/watch/replicate", watchReplicateHandler)
+	mux.HandleFunc("/replicate/batch", batchHandler)
+	mux.HandleFunc("/replicate/stream", streamHandler)
+	mux.HandleFunc("/archive/shard", archiveShardHandler)
+	mux.HandleFunc("/archive/manifest", archiveManifestHandler)
+	mux.HandleFunc("/index", indexHandler)
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/delete", deleteHandler)
+	mux.HandleFunc("/snapshot", snapshotHandler)
+	mux.HandleFunc("/merkle", merkleHandler)
+	mux.HandleFunc("/merkle/leaf", merkleLeafHandler)
 
 	httpServer := &http.Server{
 		Addr:    address,
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"crypto/sha1"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Number of levels below the root, the tree has 2^merkleDepth leaves
+const merkleDepth = 6
+
+const merkleLeaves = 1 << merkleDepth
+
+// merkleTree is a complete binary tree stored in an array, the children of node i
+// are 2i+1 and 2i+2 and the leaves start at merkleLeaves-1. Every key falls in a
+// fixed leaf so two nodes holding the same keys build the same tree.
+type merkleTree struct {
+	nodes  [][]byte
+	leaves []map[string][]byte
+}
+
+func keyBucket(name string) int {
+	sum := sha1.Sum([]byte(name))
+	return int(sum[0]) >> (8 - merkleDepth)
+}
+
+// productDigest identifies the content of a product for anti-entropy purposes. It
+// only covers the key and version, so a primary and a replica holding the same
+// version agree even if the Replicated flag differs.
+func productDigest(product common.Product) []byte {
+	sum := sha1.Sum([]byte(product.Name + "|" + product.Version.String()))
+	return sum[:]
+}
+
+func buildMerkleTree(entries map[string][]byte) *merkleTree {
+	tree := &merkleTree{
+		nodes:  make([][]byte, 2*merkleLeaves-1),
+		leaves: make([]map[string][]byte, merkleLeaves),
+	}
+
+	for i := range tree.leaves {
+		tree.leaves[i] = make(map[string][]byte)
+	}
+	for name, digest := range entries {
+		tree.leaves[keyBucket(name)][name] = digest
+	}
+
+	for i := range tree.leaves {
+		tree.hashLeaf(i)
+	}
+	// And then every inner node from the bottom up
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		tree.hashNode(i)
+	}
+
+	return tree
+}
+
+// hashLeaf hashes the keys of a leaf in order
+func (t *merkleTree) hashLeaf(bucket int) {
+	leaf := t.leaves[bucket]
+	names := make([]string, 0, len(leaf))
+	for name := range leaf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write(leaf[name])
+	}
+	t.nodes[merkleLeaves-1+bucket] = h.Sum(nil)
+}
+
+func (t *merkleTree) hashNode(i int) {
+	h := sha1.New()
+	h.Write(t.nodes[2*i+1])
+	h.Write(t.nodes[2*i+2])
+	t.nodes[i] = h.Sum(nil)
+}
+
+// set changes the digest of a key, nil removes it. Only the leaf of the key and
+// the nodes above it are hashed again.
+func (t *merkleTree) set(name string, digest []byte) {
+	bucket := keyBucket(name)
+	if digest == nil {
+		delete(t.leaves[bucket], name)
+	} else {
+		t.leaves[bucket][name] = digest
+	}
+
+	t.hashLeaf(bucket)
+	for i := merkleLeaves - 1 + bucket; i > 0; {
+		i = (i - 1) / 2
+		t.hashNode(i)
+	}
+}
+
+// clone copies the tree so it can be changed while the copy is being compared
+func (t *merkleTree) clone() *merkleTree {
+	copied := &merkleTree{
+		nodes:  append([][]byte(nil), t.nodes...),
+		leaves: make([]map[string][]byte, len(t.leaves)),
+	}
+	for i, leaf := range t.leaves {
+		copied.leaves[i] = make(map[string][]byte, len(leaf))
+		for name, digest := range leaf {
+			copied.leaves[i][name] = digest
+		}
+	}
+	return copied
+}
+
+func isMerkleLeaf(index int) bool {
+	return index >= merkleLeaves-1
+}
+
+func (t *merkleTree) leaf(index int) map[string][]byte {
+	return t.leaves[index-(merkleLeaves-1)]
+}
+
+// diffLeaves compares two leaves and returns the keys whose digest differs
+// or that only one side has
+func diffLeaves(local, remote map[string][]byte) []string {
+	var names []string
+	for name, digest := range local {
+		if other, ok := remote[name]; !ok || !bytes.Equal(digest, other) {
+			names = append(names, name)
+		}
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	digestMutex sync.Mutex
+	digests     map[string][]byte
+)
+
+// localDigests returns the digest of every local product. They are loaded from
+// disk the first time and kept up to date by storeProduct afterwards.
+func localDigests() map[string][]byte {
+	digestMutex.Lock()
+	defer digestMutex.Unlock()
+
+	if digests == nil {
+		digests = make(map[string][]byte)
+
+		names, err := listProductNames()
+		if err != nil {
+			log.Printf("Failed to list products: %v", err)
+		}
+		for _, name := range names {
+			product, found, err := readProduct(name)
+			if err != nil || !found {
+				continue
+			}
+			digests[name] = productDigest(product)
+		}
+	}
+
+	result := make(map[string][]byte, len(digests))
+	for name, digest := range digests {
+		result[name] = digest
+	}
+	return result
+}
+
+func forgetDigest(name string) {
+	digestMutex.Lock()
+	if digests != nil {
+		delete(digests, name)
+	}
+	digestMutex.Unlock()
+
+	queueRangeUpdate(name, nil)
+}
+
+func recordDigest(product common.Product) {
+	digest := productDigest(product)
+
+	digestMutex.Lock()
+	if digests != nil {
+		digests[product.Name] = digest
+	}
+	digestMutex.Unlock()
+
+	queueRangeUpdate(product.Name, digest)
+}
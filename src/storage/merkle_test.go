@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testEntries(n int) map[string][]byte {
+	entries := make(map[string][]byte)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("product-%d", i)
+		entries[name] = []byte(name + "|v1")
+	}
+	return entries
+}
+
+func TestMerkleSameEntries(t *testing.T) {
+	a := buildMerkleTree(testEntries(200))
+	b := buildMerkleTree(testEntries(200))
+
+	if !bytes.Equal(a.nodes[0], b.nodes[0]) {
+		t.Fatalf("expected equal roots")
+	}
+}
+
+func TestMerkleDiffersInOneLeaf(t *testing.T) {
+	local := testEntries(200)
+	remote := testEntries(200)
+	remote["product-42"] = []byte("product-42|v2")
+
+	a := buildMerkleTree(local)
+	b := buildMerkleTree(remote)
+
+	if bytes.Equal(a.nodes[0], b.nodes[0]) {
+		t.Fatalf("expected different roots")
+	}
+
+	differing := 0
+	for i := merkleLeaves - 1; i < len(a.nodes); i++ {
+		if !bytes.Equal(a.nodes[i], b.nodes[i]) {
+			differing++
+			names := diffLeaves(a.leaf(i), b.leaf(i))
+			if len(names) != 1 || names[0] != "product-42" {
+				t.Fatalf("unexpected diff %v", names)
+			}
+		}
+	}
+
+	if differing != 1 {
+		t.Fatalf("expected a single differing leaf, got %d", differing)
+	}
+}
+
+func TestDiffLeavesMissingKeys(t *testing.T) {
+	local := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	remote := map[string][]byte{"b": []byte("2"), "c": []byte("3")}
+
+	names := diffLeaves(local, remote)
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Fatalf("unexpected diff %v", names)
+	}
+}
+
+func TestMerkleSetMatchesRebuild(t *testing.T) {
+	entries := testEntries(200)
+	tree := buildMerkleTree(entries)
+
+	entries["product-7"] = []byte("product-7|v2")
+	delete(entries, "product-42")
+	entries["product-500"] = []byte("product-500|v1")
+	tree.set("product-7", []byte("product-7|v2"))
+	tree.set("product-42", nil)
+	tree.set("product-500", []byte("product-500|v1"))
+
+	if !bytes.Equal(tree.nodes[0], buildMerkleTree(entries).nodes[0]) {
+		t.Fatalf("expected the updated tree to match a rebuilt one")
+	}
+}
+
+func TestRangeIndexAppliesWrites(t *testing.T) {
+	owners := []string{"a:1", "b:1"}
+	index := &rangeIndex{
+		owners: map[string][]string{"product-1": owners, "product-2": owners},
+		trees:  make(map[rangePair]*merkleTree),
+		shared: make(map[rangePair]bool),
+	}
+	index.set("product-1", owners, []byte("product-1|v1"))
+	index.set("product-2", owners, []byte("product-2|v1"))
+
+	pair := rangePair{owner: "a:1", replica: "b:1"}
+	index.shared[pair] = true
+	handedOut := index.trees[pair]
+	before := handedOut.nodes[0]
+
+	takeRangeUpdates()
+	queueRangeUpdate("product-1", []byte("product-1|v2"))
+	queueRangeUpdate("product-2", nil)
+	// Only keys written for the first time are looked up, there are none
+	index.applyRangeUpdates(nil)
+
+	expected := buildMerkleTree(map[string][]byte{"product-1": []byte("product-1|v2")})
+	if !bytes.Equal(index.trees[pair].nodes[0], expected.nodes[0]) {
+		t.Fatalf("expected the writes to be in the tree")
+	}
+	if !bytes.Equal(handedOut.nodes[0], before) {
+		t.Fatalf("expected the tree handed out to a sync to be left alone")
+	}
+	if _, ok := index.owners["product-2"]; ok {
+		t.Fatalf("expected the removed key to be forgotten")
+	}
+}
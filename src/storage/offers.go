@@ -0,0 +1,55 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"net/http"
+)
+
+// How many listings of the same category are compared against the product
+const offerCandidates = 1000
+
+// offersHandler answers the listings of the same item as the product in every
+// store, so their prices can be compared
+func offersHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	product, found, err := quorumRead(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !found || product.Deleted {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// Listings of the same item always share the category, so the secondary
+	// index keeps the candidates small
+	candidates := scatterQuery(productQuery{
+		Category: common.CategoryOf(product),
+		Sort:     "price",
+		Limit:    offerCandidates,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(common.OffersFor(product, candidates))
+}
+
+// writeProducts answers the products as they are, or grouped by item when the
+// request asks for group=offers
+func writeProducts(w http.ResponseWriter, r *http.Request, products []common.Product) {
+	var response interface{} = products
+	if r.URL.Query().Get("group") == "offers" {
+		response = common.GroupOffers(products)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode products", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"chord"
+	common "commons"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// sameHost tells if the chord address is the given host, which may leave out the
+// port
+func sameHost(host string, other string) bool {
+	return other != "" && (host == other || strings.Split(host, ":")[0] == other)
+}
+
+// ownedRanges returns the ranges between the predecessor of every local vnode and
+// the vnode
+func ownedRanges(ring *chord.Ring) []common.OwnedRange {
+	var ranges []common.OwnedRange
+	for _, vnode := range ring.Vnodes {
+		r := common.OwnedRange{Vnode: hex.EncodeToString(vnode.Id), End: hex.EncodeToString(vnode.Id)}
+		if vnode.Predecessor != nil {
+			r.Start = hex.EncodeToString(vnode.Predecessor.Id)
+		}
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].End < ranges[j].End
+	})
+	return ranges
+}
+
+// placeKey classifies the owners of a key by what they hold. held has the digests
+// of every host that answered, the host in without is counted as gone.
+func placeKey(key string, digest string, owners []string, held map[string]map[string]string, without string) common.KeyPlacement {
+	placement := common.KeyPlacement{Key: key, Owners: owners, Live: []string{}}
+
+	for _, owner := range owners {
+		keys, answered := held[owner]
+		remote, ok := keys[key]
+		if !answered || !ok || sameHost(owner, without) {
+			placement.Missing = append(placement.Missing, owner)
+			continue
+		}
+
+		placement.Live = append(placement.Live, owner)
+		if remote != digest {
+			placement.Stale = append(placement.Stale, owner)
+		}
+	}
+	return placement
+}
+
+// reportedByReplica tells if this node reports a key it holds as a replica. That
+// is the case when the primary has no copy, didn't answer or is the host counted
+// as gone, and no replica before this one in the owners holds a copy.
+func reportedByReplica(key string, owners []string, held map[string]map[string]string, without string) bool {
+	if len(owners) == 0 || owners[0] == addr {
+		return false
+	}
+	if keys, answered := held[owners[0]]; answered && !sameHost(owners[0], without) {
+		if _, ok := keys[key]; ok {
+			return false
+		}
+	}
+
+	for _, owner := range owners[1:] {
+		if owner == addr {
+			return true
+		}
+		if _, ok := held[owner][key]; ok && !sameHost(owner, without) {
+			return false
+		}
+	}
+	return false
+}
+
+func localKeys() map[string]string {
+	keys := make(map[string]string)
+	for name, digest := range localDigests() {
+		keys[name] = hex.EncodeToString(digest)
+	}
+	return keys
+}
+
+// ownershipReport checks the replicas of every key this node is the primary owner
+// of. The keys of every owner are fetched once, not one request per key.
+func ownershipReport(ring *chord.Ring, without string, detail bool) common.OwnershipReport {
+	report := common.OwnershipReport{
+		Node:            addr,
+		Zone:            zone,
+		Replicas:        replicaCount(),
+		Ranges:          ownedRanges(ring),
+		Without:         without,
+		UnderReplicated: []common.KeyPlacement{},
+	}
+
+	local := localKeys()
+	held := map[string]map[string]string{addr: local}
+
+	primary := make(map[string][]string)
+	replicas := make(map[string][]string)
+	for name := range local {
+		owners, err := ownersOf(ring, name, replicaCount())
+		if err != nil {
+			log.Printf("Lookup failed for %s: %v", name, err)
+			continue
+		}
+
+		switch {
+		case len(owners) > 0 && owners[0] == addr:
+			report.Owned++
+			primary[name] = owners
+		case contains(owners, addr):
+			report.Replica++
+			replicas[name] = owners
+		default:
+			report.Misplaced++
+		}
+
+		for _, owner := range owners {
+			if _, ok := held[owner]; ok || contains(report.Unreachable, owner) {
+				continue
+			}
+
+			var keys map[string]string
+			if err := getJSON("http://"+httpAddress(owner)+"/admin/keys", &keys); err != nil {
+				log.Printf("Failed to get the keys of %s: %v", owner, err)
+				report.Unreachable = append(report.Unreachable, owner)
+				continue
+			}
+			held[owner] = keys
+		}
+	}
+
+	for name, owners := range primary {
+		placement := placeKey(name, local[name], owners, held, without)
+		if len(placement.Live) < report.Replicas {
+			report.UnderReplicated = append(report.UnderReplicated, placement)
+		}
+		if detail {
+			report.Keys = append(report.Keys, placement)
+		}
+	}
+
+	// Nobody else reports the keys missing from their primary
+	for name, owners := range replicas {
+		if !reportedByReplica(name, owners, held, without) {
+			continue
+		}
+		placement := placeKey(name, local[name], owners, held, without)
+		if len(placement.Live) < report.Replicas {
+			report.UnderReplicated = append(report.UnderReplicated, placement)
+		}
+	}
+
+	sort.Slice(report.UnderReplicated, func(i, j int) bool {
+		return report.UnderReplicated[i].Key < report.UnderReplicated[j].Key
+	})
+	sort.Slice(report.Keys, func(i, j int) bool {
+		return report.Keys[i].Key < report.Keys[j].Key
+	})
+	return report
+}
+
+// ownershipHandler reports the ranges and keys this node owns and the keys with
+// fewer live replicas than the replication factor. With without=<host> that host
+// is counted as down, detail=keys lists the replicas of every owned key.
+func ownershipHandler(w http.ResponseWriter, r *http.Request) {
+	without := r.URL.Query().Get("without")
+	detail := r.URL.Query().Get("detail") == "keys"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ownershipReport(ring, without, detail))
+}
+
+// adminKeysHandler lists the digest of every local key, or of one key
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := localKeys()
+	if key := r.URL.Query().Get("key"); key != "" {
+		keys = map[string]string{key: keys[key]}
+		if keys[key] == "" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// keyPlacementHandler shows where the replicas of a single key are, it can be
+// asked to any node
+func keyPlacementHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	owners, err := ownersOf(ring, key, replicaCount())
+	if err != nil || len(owners) == 0 {
+		http.Error(w, "Lookup failed", http.StatusInternalServerError)
+		return
+	}
+
+	// The copies are compared against the newest one, the primary may not have
+	// any
+	held := make(map[string]map[string]string)
+	var newest common.Product
+	found := false
+	for _, owner := range owners {
+		product, ok, err := fetchFromReplica(owner, key)
+		if err != nil {
+			log.Printf("Failed to fetch %s from %s: %v", key, owner, err)
+			continue
+		}
+
+		held[owner] = map[string]string{}
+		if !ok {
+			continue
+		}
+		held[owner][key] = hex.EncodeToString(productDigest(product))
+		if !found || product.Version.Compare(newest.Version) > 0 {
+			newest = product
+			found = true
+		}
+	}
+
+	digest := ""
+	if found {
+		digest = hex.EncodeToString(productDigest(newest))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(placeKey(key, digest, owners, held, r.URL.Query().Get("without")))
+}
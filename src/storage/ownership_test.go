@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaceKey(t *testing.T) {
+	owners := []string{"10.0.0.1:10000", "10.0.0.2:10000", "10.0.0.3:10000"}
+	held := map[string]map[string]string{
+		"10.0.0.1:10000": {"product": "aa"},
+		"10.0.0.2:10000": {"product": "bb"},
+		// 10.0.0.3 didn't answer
+	}
+
+	placement := placeKey("product", "aa", owners, held, "")
+	if !reflect.DeepEqual(placement.Live, owners[:2]) || !reflect.DeepEqual(placement.Stale, owners[1:2]) ||
+		!reflect.DeepEqual(placement.Missing, owners[2:]) {
+		t.Fatalf("unexpected placement %+v", placement)
+	}
+
+	// Taking 10.0.0.2 down leaves a single copy
+	placement = placeKey("product", "aa", owners, held, "10.0.0.2")
+	if !reflect.DeepEqual(placement.Live, owners[:1]) || len(placement.Missing) != 2 {
+		t.Fatalf("unexpected placement %+v", placement)
+	}
+}
+
+func TestReportedByReplica(t *testing.T) {
+	addr = "10.0.0.2:10000"
+	defer func() { addr = "" }()
+	owners := []string{"10.0.0.1:10000", "10.0.0.2:10000", "10.0.0.3:10000"}
+
+	// The primary has its copy and reports the key itself
+	held := map[string]map[string]string{"10.0.0.1:10000": {"product": "aa"}, "10.0.0.2:10000": {"product": "aa"}}
+	if reportedByReplica("product", owners, held, "") {
+		t.Fatal("expected the primary to report the key")
+	}
+
+	// The primary lost it, the first replica holding a copy reports it
+	held["10.0.0.1:10000"] = map[string]string{}
+	if !reportedByReplica("product", owners, held, "") {
+		t.Fatal("expected the replica to report the key missing from its primary")
+	}
+	if !reportedByReplica("product", owners, map[string]map[string]string{"10.0.0.2:10000": {"product": "aa"}}, "") {
+		t.Fatal("expected the replica to report the key of an unreachable primary")
+	}
+
+	addr = "10.0.0.3:10000"
+	if reportedByReplica("product", owners, held, "") {
+		t.Fatal("expected only the first replica holding a copy to report the key")
+	}
+}
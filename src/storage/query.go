@@ -0,0 +1,389 @@
+package main
+
+import (
+	"chord"
+	common "commons"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultQueryLimit = 50
+
+// productQuery holds the filters, the order and the limit of a /query request
+type productQuery struct {
+	MinPrice  float64
+	MaxPrice  float64
+	MinRating float64
+	Source    string
+	Category  string
+	PriceBand string
+	Name      string
+	Sort      string
+	Limit     int
+	// Only match keys whose primary owner is this host, used while scattering
+	Owner string
+	// Return every copy in the range of Owner, tombstones included, leaving the
+	// filters to whoever merges them. Used for the range of a failed host.
+	Unfiltered bool
+}
+
+var sortOrders = map[string]bool{
+	"price": true, "-price": true,
+	"rating": true, "-rating": true,
+	"name": true, "-name": true,
+}
+
+func parseFloatParam(values url.Values, name string) (float64, error) {
+	raw := values.Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	return value, nil
+}
+
+func parseQuery(values url.Values) (productQuery, error) {
+	q := productQuery{
+		Source:     strings.ToLower(values.Get("source")),
+		Category:   strings.ToLower(values.Get("category")),
+		PriceBand:  values.Get("price_band"),
+		Name:       strings.ToLower(values.Get("name")),
+		Sort:       values.Get("sort"),
+		Limit:      defaultQueryLimit,
+		Owner:      values.Get("owner"),
+		Unfiltered: values.Get("unfiltered") == "true",
+	}
+
+	if q.PriceBand != "" && !isPriceBand(q.PriceBand) {
+		return q, fmt.Errorf("invalid price_band: %s", q.PriceBand)
+	}
+
+	var err error
+	if q.MinPrice, err = parseFloatParam(values, "min_price"); err != nil {
+		return q, err
+	}
+	if q.MaxPrice, err = parseFloatParam(values, "max_price"); err != nil {
+		return q, err
+	}
+	if q.MinRating, err = parseFloatParam(values, "min_rating"); err != nil {
+		return q, err
+	}
+
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	if !sortOrders[q.Sort] {
+		return q, fmt.Errorf("invalid sort: %s", q.Sort)
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		q.Limit, err = strconv.Atoi(raw)
+		if err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("invalid limit: %s", raw)
+		}
+	}
+
+	return q, nil
+}
+
+// values encodes the query so it can be forwarded to other nodes
+func (q productQuery) values() url.Values {
+	values := url.Values{}
+	if q.MinPrice > 0 {
+		values.Set("min_price", strconv.FormatFloat(q.MinPrice, 'f', -1, 64))
+	}
+	if q.MaxPrice > 0 {
+		values.Set("max_price", strconv.FormatFloat(q.MaxPrice, 'f', -1, 64))
+	}
+	if q.MinRating > 0 {
+		values.Set("min_rating", strconv.FormatFloat(q.MinRating, 'f', -1, 64))
+	}
+	if q.Source != "" {
+		values.Set("source", q.Source)
+	}
+	if q.Category != "" {
+		values.Set("category", q.Category)
+	}
+	if q.PriceBand != "" {
+		values.Set("price_band", q.PriceBand)
+	}
+	if q.Name != "" {
+		values.Set("name", q.Name)
+	}
+	if q.Owner != "" {
+		values.Set("owner", q.Owner)
+	}
+	if q.Unfiltered {
+		values.Set("unfiltered", "true")
+	}
+	values.Set("sort", q.Sort)
+	values.Set("limit", strconv.Itoa(q.Limit))
+	return values
+}
+
+// sourceOf and ratingOf fall back to the URL and the rating text for products
+// that haven't been normalized
+func sourceOf(product common.Product) string {
+	if product.Source != "" {
+		return product.Source
+	}
+	return common.SourceFromURL(product.URL)
+}
+
+func ratingOf(product common.Product) float64 {
+	if product.RatingValue > 0 {
+		return product.RatingValue
+	}
+	return common.ParseRating(product.Rating)
+}
+
+func (q productQuery) matches(product common.Product) bool {
+	price := product.Price
+	if q.MinPrice > 0 && price < q.MinPrice {
+		return false
+	}
+	if q.MaxPrice > 0 && price > q.MaxPrice {
+		return false
+	}
+	if q.MinRating > 0 && ratingOf(product) < q.MinRating {
+		return false
+	}
+	if q.Source != "" && sourceOf(product) != q.Source {
+		return false
+	}
+	if q.Category != "" && common.CategoryOf(product) != q.Category {
+		return false
+	}
+	if q.PriceBand != "" && priceBandOf(price) != q.PriceBand {
+		return false
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(product.Name), q.Name) {
+		return false
+	}
+	return true
+}
+
+func (q productQuery) less(a, b common.Product) bool {
+	field := strings.TrimPrefix(q.Sort, "-")
+	descending := strings.HasPrefix(q.Sort, "-")
+
+	var cmp int
+	switch field {
+	case "price":
+		cmp = compareFloats(a.Price, b.Price)
+	case "rating":
+		cmp = compareFloats(ratingOf(a), ratingOf(b))
+	}
+	if cmp == 0 {
+		// Ties and the name order fall back to the key so the result is stable
+		cmp = strings.Compare(a.Name, b.Name)
+	}
+
+	if descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (q productQuery) sortAndLimit(products []common.Product) []common.Product {
+	sort.Slice(products, func(i, j int) bool {
+		return q.less(products[i], products[j])
+	})
+
+	if len(products) > q.Limit {
+		products = products[:q.Limit]
+	}
+	return products
+}
+
+// localQuery runs the query against the products stored in this node
+func localQuery(q productQuery) ([]common.Product, error) {
+	names, indexed := q.candidates()
+	if !indexed || q.Unfiltered {
+		var err error
+		if names, err = listProductNames(); err != nil {
+			return nil, err
+		}
+	}
+
+	var primaries map[string]string
+	if q.Owner != "" {
+		primaries = primaryOwners(ring, names)
+	}
+
+	products := []common.Product{}
+	for _, name := range names {
+		if q.Owner != "" && primaries[name] != q.Owner {
+			continue
+		}
+
+		product, found, err := readProduct(name)
+		if err != nil || !found {
+			continue
+		}
+		if q.Unfiltered {
+			products = append(products, product)
+			continue
+		}
+		if product.Deleted || !q.matches(product) {
+			continue
+		}
+
+		products = append(products, product)
+	}
+
+	if q.Unfiltered {
+		return products, nil
+	}
+	return q.sortAndLimit(products), nil
+}
+
+// clusterHosts returns every storage host this node knows about through its vnodes
+func clusterHosts(ring *chord.Ring) []string {
+	hosts := []string{addr}
+	for _, vnode := range ring.Vnodes {
+		for _, succ := range vnode.Successors {
+			if succ != nil && !contains(hosts, succ.Host) {
+				hosts = append(hosts, succ.Host)
+			}
+		}
+		if vnode.Predecessor != nil && !contains(hosts, vnode.Predecessor.Host) {
+			hosts = append(hosts, vnode.Predecessor.Host)
+		}
+	}
+	return hosts
+}
+
+func remoteQuery(host string, q productQuery) ([]common.Product, error) {
+	values := q.values()
+	values.Set("scope", "local")
+
+	var products []common.Product
+	err := getJSON("http://"+httpAddress(host)+"/query?"+values.Encode(), &products)
+	return products, err
+}
+
+// scatterQuery sends the query to every host asking each one for the range it is
+// the primary owner of. The ranges of the hosts that don't answer are asked to
+// the rest, which hold their replicas.
+func scatterQuery(q productQuery) []common.Product {
+	hosts := clusterHosts(ring)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var partials [][]common.Product
+	var failed []string
+	var answered []string
+
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			ranged := q
+			ranged.Owner = host
+			products, err := remoteQuery(host, ranged)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Query to %s failed: %v", host, err)
+				failed = append(failed, host)
+				return
+			}
+			answered = append(answered, host)
+			partials = append(partials, products)
+		}(host)
+	}
+	wg.Wait()
+
+	for _, owner := range failed {
+		for _, host := range answered {
+			wg.Add(1)
+			go func(host string, owner string) {
+				defer wg.Done()
+
+				// The replicas may hold different versions, they are only
+				// filtered once the newest one is known
+				ranged := q
+				ranged.Owner = owner
+				ranged.Unfiltered = true
+				products, err := remoteQuery(host, ranged)
+				if err != nil {
+					log.Printf("Query to %s for the range of %s failed: %v", host, owner, err)
+					return
+				}
+
+				mu.Lock()
+				partials = append(partials, products)
+				mu.Unlock()
+			}(host, owner)
+		}
+	}
+	wg.Wait()
+
+	return mergePartials(q, partials)
+}
+
+// mergePartials joins the partial results keeping the newest version of the
+// products more than one replica returned, then filters them
+func mergePartials(q productQuery, partials [][]common.Product) []common.Product {
+	newest := make(map[string]common.Product)
+	for _, partial := range partials {
+		for _, product := range partial {
+			if current, ok := newest[product.Name]; !ok || product.Version.Compare(current.Version) > 0 {
+				newest[product.Name] = product
+			}
+		}
+	}
+
+	products := make([]common.Product, 0, len(newest))
+	for _, product := range newest {
+		if !product.Deleted && q.matches(product) {
+			products = append(products, product)
+		}
+	}
+
+	return q.sortAndLimit(products)
+}
+
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var products []common.Product
+	if r.URL.Query().Get("scope") == "local" {
+		products, err = localQuery(q)
+		if err != nil {
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		products = scatterQuery(q)
+	}
+
+	writeProducts(w, r, products)
+}
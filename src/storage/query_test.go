@@ -0,0 +1,93 @@
+package main
+
+import (
+	common "commons"
+	"net/url"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	values, _ := url.ParseQuery("max_price=500&name=RTX&sort=-price&limit=5&source=Newegg")
+	q, err := parseQuery(values)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if q.MaxPrice != 500 || q.Name != "rtx" || q.Sort != "-price" || q.Limit != 5 || q.Source != "newegg" {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	if _, err := parseQuery(url.Values{"sort": {"color"}}); err == nil {
+		t.Fatalf("expected error for unknown sort")
+	}
+	if _, err := parseQuery(url.Values{"limit": {"-1"}}); err == nil {
+		t.Fatalf("expected error for negative limit")
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	q := productQuery{MaxPrice: 500, MinRating: 4, Source: "newegg", Name: "rtx", Sort: "price", Limit: 10}
+
+	product := common.Product{
+		Name:   "MSI GeForce RTX 4060",
+		Price:  299.99,
+		Rating: "Rating + 4.5 out of 5 eggs",
+		URL:    "https://www.newegg.com/p/N82E16814137797",
+	}
+	if !q.matches(product) {
+		t.Fatalf("expected product to match")
+	}
+
+	product.Price = 799
+	if q.matches(product) {
+		t.Fatalf("expected expensive product not to match")
+	}
+
+	product.Price = 299.99
+	product.URL = "https://www.amazon.com/dp/B0C8ZQTRD7"
+	if q.matches(product) {
+		t.Fatalf("expected amazon product not to match")
+	}
+}
+
+func TestMergePartials(t *testing.T) {
+	q := productQuery{Sort: "price", Limit: 2}
+
+	old := common.Product{Name: "b", Price: 10, Version: common.Version{WallTime: 1}}
+	updated := common.Product{Name: "b", Price: 5, Version: common.Version{WallTime: 2}}
+	partials := [][]common.Product{
+		{{Name: "a", Price: 7}, old},
+		{updated, {Name: "c", Price: 20}},
+	}
+
+	products := mergePartials(q, partials)
+	if len(products) != 2 || products[0].Name != "b" || products[0].Price != 5 || products[1].Name != "a" {
+		t.Fatalf("unexpected result %+v", products)
+	}
+}
+
+func TestMergePartialsFiltersNewest(t *testing.T) {
+	q := productQuery{Sort: "name", Limit: 10, MaxPrice: 100}
+
+	// One replica has the old version matching the filter, another the newer one
+	// that doesn't, and a third the tombstone of a product
+	partials := [][]common.Product{
+		{{Name: "a", Price: 50, Version: common.Version{WallTime: 1}}, {Name: "b", Price: 20, Version: common.Version{WallTime: 1}}},
+		{{Name: "a", Price: 500, Version: common.Version{WallTime: 2}}},
+		{{Name: "b", Deleted: true, Version: common.Version{WallTime: 2}}},
+	}
+
+	if products := mergePartials(q, partials); len(products) != 0 {
+		t.Fatalf("expected the outdated copies to be left out, got %+v", products)
+	}
+}
+
+func TestSameSuccessor(t *testing.T) {
+	if !sameSuccessor([]byte{0x10}, []byte{0x20}, []byte{0x20}) || sameSuccessor([]byte{0x10}, []byte{0x20}, []byte{0x21}) {
+		t.Fatal("expected the range to end at the successor")
+	}
+	// The successor of a key near the end of the ring is at its start
+	if !sameSuccessor([]byte{0xf0}, []byte{0x05}, []byte{0xff}) {
+		t.Fatal("expected the rest of the ring to have the same successor")
+	}
+}
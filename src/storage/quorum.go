@@ -0,0 +1,144 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+type replicaResponse struct {
+	host    string
+	product common.Product
+	found   bool
+}
+
+// quorumRead asks every owner of the key for its copy and returns once R of them
+// answered. The newest version among the answers wins.
+func quorumRead(key string) (common.Product, bool, error) {
+	owners, err := ownersOf(ring, key, replicaCount())
+	if err != nil {
+		return common.Product{}, false, err
+	}
+
+	responses := make(chan replicaResponse, len(owners))
+	failures := make(chan error, len(owners))
+
+	for _, owner := range owners {
+		go func(owner string) {
+			product, found, err := fetchFromReplica(owner, key)
+			if err != nil {
+				failures <- err
+				return
+			}
+			responses <- replicaResponse{host: owner, product: product, found: found}
+		}(owner)
+	}
+
+	var answers []replicaResponse
+	failed := 0
+	for len(answers) < readQuorum() && len(answers)+failed < len(owners) {
+		select {
+		case response := <-responses:
+			answers = append(answers, response)
+		case err := <-failures:
+			log.Printf("Quorum read of %s: %v", key, err)
+			failed++
+		}
+	}
+
+	if len(answers) < readQuorum() {
+		return common.Product{}, false, fmt.Errorf("read quorum not reached: %d/%d responses", len(answers), readQuorum())
+	}
+
+	var newest common.Product
+	found := false
+	for _, answer := range answers {
+		if answer.found && (!found || answer.product.Version.Compare(newest.Version) > 0) {
+			newest = answer.product
+			found = true
+		}
+	}
+
+	if found {
+		go readRepair(newest, answers, owners[0])
+	}
+
+	return newest, found, nil
+}
+
+// readRepair sends the newest version to the replicas that answered with an older one
+func readRepair(newest common.Product, answers []replicaResponse, primary string) {
+	for _, answer := range answers {
+		if answer.found && answer.product.Version.Compare(newest.Version) >= 0 {
+			continue
+		}
+
+		repaired := newest
+		repaired.Replicated = answer.host != primary
+		err := SendProductRequest(repaired, httpAddress(answer.host))
+		if err != nil {
+			log.Printf("Read repair of %s on %s failed: %v", newest.Name, answer.host, err)
+		}
+	}
+}
+
+func fetchFromReplica(host string, key string) (common.Product, bool, error) {
+	var product common.Product
+
+	resp, err := antiEntropyClient.Get("http://" + httpAddress(host) + "/fetch?key=" + url.QueryEscape(key))
+	if err != nil {
+		return product, false, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return product, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return product, false, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		return product, false, err
+	}
+
+	if !common.VerifyChecksum(product) {
+		return product, false, fmt.Errorf("copy of %s on %s is corrupt", key, host)
+	}
+
+	return product, true, nil
+}
+
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	product, found, err := quorumRead(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !found || product.Deleted {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
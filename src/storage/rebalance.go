@@ -0,0 +1,110 @@
+package main
+
+import (
+	"chord"
+	common "commons"
+	"log"
+	"sort"
+)
+
+// rebalance hands off the keys this node is no longer an owner of and removes the
+// local copy once every current owner acknowledged holding it, so the replication
+// factor bounds the disk usage of the cluster. The keys are sent in batches, one
+// stream of them per owner.
+func rebalance(ring *chord.Ring) {
+	moving := make(map[string][]string)
+	byOwner := make(map[string][]string)
+
+	for name := range localDigests() {
+		owners, err := ownersOf(ring, name, replicaCount())
+		if err != nil {
+			log.Printf("Lookup failed for %s: %v", name, err)
+			continue
+		}
+
+		// While the cluster is smaller than the replication factor we own everything
+		if len(owners) == 0 || contains(owners, addr) {
+			continue
+		}
+
+		moving[name] = owners
+		for _, owner := range owners {
+			byOwner[owner] = append(byOwner[owner], name)
+		}
+	}
+
+	// Every owner has to acknowledge the same version, one written while the
+	// product was being sent goes out on the next round
+	acked := make(map[string]map[string]common.Product)
+	for owner, names := range byOwner {
+		sort.Strings(names)
+
+		products, err := pushRecords(owner, names)
+		if err != nil {
+			log.Printf("Owner %s didn't acknowledge every product: %v", owner, err)
+		}
+		for _, product := range products {
+			if acked[product.Name] == nil {
+				acked[product.Name] = make(map[string]common.Product)
+			}
+			acked[product.Name][owner] = product
+		}
+	}
+
+	for name, owners := range moving {
+		product, ok := ackedByOwners(owners, acked[name])
+		if !ok {
+			continue
+		}
+		if releaseProduct(product, owners) {
+			log.Printf("Moved %s to its new owners %v", name, owners)
+		}
+	}
+}
+
+// ackedByOwners returns the version of a product every owner acknowledged, it is
+// not released when one of them didn't or got another version
+func ackedByOwners(owners []string, acked map[string]common.Product) (common.Product, bool) {
+	var product common.Product
+	for i, owner := range owners {
+		got, ok := acked[owner]
+		if !ok || (i > 0 && got.Version.Compare(product.Version) != 0) {
+			return common.Product{}, false
+		}
+		product = got
+	}
+	return product, len(owners) > 0
+}
+
+// releaseProduct removes the local copy of a product every owner holds, unless a
+// newer version was written after it was sent
+func releaseProduct(product common.Product, owners []string) bool {
+	name := product.Name
+
+	if err := handOffArchive(name, owners); err != nil {
+		log.Printf("Failed to hand off the archive of %s: %v", name, err)
+		return false
+	}
+
+	// A newer version keeps its history and archive too
+	removed, err := removeProduct(product)
+	if err != nil {
+		log.Printf("Failed to remove %s: %v", name, err)
+		return false
+	}
+	if !removed {
+		return false
+	}
+
+	historyMutex.Lock()
+	err = walRemove(historyPath(name))
+	historyMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to remove the history of %s: %v", name, err)
+	}
+	if err := forgetArchive(name); err != nil {
+		log.Printf("Failed to remove the archive manifest of %s: %v", name, err)
+	}
+
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	common "commons"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAckedByOwners(t *testing.T) {
+	owners := []string{"a:1", "b:1"}
+	v1 := common.Product{Name: "p", Version: common.Version{WallTime: 1, Node: "n"}}
+	v2 := common.Product{Name: "p", Version: common.Version{WallTime: 2, Node: "n"}}
+
+	if _, ok := ackedByOwners(owners, map[string]common.Product{"a:1": v1}); ok {
+		t.Fatal("expected a key to be kept until every owner acknowledged it")
+	}
+	if _, ok := ackedByOwners(owners, map[string]common.Product{"a:1": v1, "b:1": v2}); ok {
+		t.Fatal("expected a key to be kept when the owners acknowledged different versions")
+	}
+	if _, ok := ackedByOwners(owners, map[string]common.Product{"a:1": v1, "c:1": v1, "d:1": v1}); ok {
+		t.Fatal("expected acknowledgements from other hosts not to count")
+	}
+	if product, ok := ackedByOwners(owners, map[string]common.Product{"a:1": v2, "b:1": v2}); !ok || product.Version != v2.Version {
+		t.Fatalf("expected the acknowledged version to be released, got %+v %v", product, ok)
+	}
+}
+
+func TestReleaseProductKeepsNewerVersion(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	sent := common.Product{Name: "p", Price: 10, Replicated: true, Version: common.Version{WallTime: 1, Node: "n"}}
+	newer := sent
+	newer.Price = 12
+	newer.Version = common.Version{WallTime: 2, Node: "n"}
+	if _, err := storeProduct(newer); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := mergeHistory("p", []common.PricePoint{{Time: start, Price: 10}, {Time: start.Add(time.Hour), Price: 12}}); err != nil {
+		t.Fatal(err)
+	}
+	segment := ArchiveSegment{ID: "0a1d", Key: "p", From: start, To: start, Version: common.Version{WallTime: 1, Node: "n"}}
+	if _, err := storeSegment(segment); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write came in after the old version was sent to the owners, no owners
+	// are given so the archive isn't sent anywhere
+	if releaseProduct(sent, nil) {
+		t.Fatal("expected the newer version not to be released")
+	}
+	if product, found, err := readProduct("p"); err != nil || !found || product.Price != 12 {
+		t.Fatalf("expected the newer version to stay, got %+v %v %v", product, found, err)
+	}
+	if history, err := readHistory("p"); err != nil || len(history) != 1 {
+		t.Fatalf("expected the history to stay, got %+v %v", history, err)
+	}
+	if segments, err := readManifest("p"); err != nil || len(segments) != 1 {
+		t.Fatalf("expected the archive to stay, got %+v %v", segments, err)
+	}
+
+	if !releaseProduct(newer, nil) {
+		t.Fatal("expected the acknowledged version to be released")
+	}
+	if _, err := os.Stat(productPath("p")); !os.IsNotExist(err) {
+		t.Fatalf("expected the acknowledged version to be removed, got %v", err)
+	}
+	if _, err := os.Stat(historyPath("p")); !os.IsNotExist(err) {
+		t.Fatalf("expected the history to be removed, got %v", err)
+	}
+}
@@ -24,14 +24,10 @@ func init() {
 }
 
 func lookupAndReplicateIfNecessary(ring *chord.Ring, product *common.Product) {
-	currentSuccessors, err := ring.Lookup(3, []byte(product.Name))
+	currentSuccessorAddresses, err := ownersOf(ring, product.Name, replicaCount())
 	if err != nil {
-		log.Fatalf("Lookup failed: %v", err)
-	}
-
-	currentSuccessorAddresses := make([]string, 3)
-	for i, succ := range currentSuccessors {
-		currentSuccessorAddresses[i] = succ.Host
+		log.Printf("Lookup failed: %v", err)
+		return
 	}
 
 	previousSuccessorAddresses, found := previousSuccessors[product.Name]
@@ -81,8 +77,7 @@ func replicateProduct(endpoint string, product common.Product) error {
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := replicationClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
@@ -139,7 +134,7 @@ func replicateNewFiles(ctx context.Context, n *node.ChordNode, predecessor *node
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = ioutil.WriteFile(n.Address+"/"+file.Name(), updatedData, 0644)
+			err = writeFileAtomic(n.Address+"/"+file.Name(), updatedData)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -181,74 +176,6 @@ func replicateNewFiles(ctx context.Context, n *node.ChordNode, predecessor *node
 //	}
 //}
 
-var previousStorageNodes = make(map[string][]string)
-
-func shouldReplicate(productName string, currentStorageNodes []string) bool {
-	previousNodes, exists := previousStorageNodes[productName]
-	if !exists {
-		// If it's the first time, always replicate
-		return true
-	}
-
-	if len(previousNodes) != len(currentStorageNodes) {
-		// Different number of nodes, should replicate
-		return true
-	}
-
-	// Check if all nodes are the same
-	for _, node := range currentStorageNodes {
-		if !contains(previousNodes, node) {
-			return true
-		}
-	}
-
-	// If all nodes are the same, no need to replicate
-	return false
-}
-
-func blackholeReplicate(ring *chord.Ring, host string, files []os.FileInfo) {
-	// Get all the storage nodes
-
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			data, err := os.ReadFile(host + "/" + file.Name())
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			var product common.Product
-			err = json.Unmarshal(data, &product)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			storageNodes := getAllPredecessors(ring, []byte(product.Name))
-
-			if shouldReplicate(product.Name, storageNodes) {
-
-				previousStorageNodes[product.Name] = storageNodes[:]
-
-				for _, address := range storageNodes {
-
-					fullEndpoint := "http://" + address + ":10001/replicate"
-					err = replicateProduct(fullEndpoint, product)
-					if err != nil {
-						fmt.Printf("Error while replicating %s to %s: %s\n", product.Name, fullEndpoint, err.Error())
-						continue
-					}
-
-					// Log replicated data
-					log.Printf("Replicated data with node %v, node address %v\n", address, host)
-				}
-			} else {
-				log.Printf("No need for replication on %s\n", product.Name)
-			}
-
-		}
-	}
-
-}
-
 func ReplicateData(ctx context.Context, n *chord.Ring, address string, interval time.Duration) {
 
 	//lastPredecessor := &node.ChordNode{}
@@ -256,14 +183,19 @@ func ReplicateData(ctx context.Context, n *chord.Ring, address string, interval
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		files, err := ioutil.ReadDir("./" + address)
-		if err != nil {
-			log.Fatal(err)
+	for {
+		// A change of the replication factor is applied right away
+		select {
+		case <-ticker.C:
+		case <-replicationChanged:
+			log.Printf("Replication factor is now %d, adjusting replicas", replicaCount())
 		}
 
-		// blachole replicate
-		blackholeReplicate(ring, address, files)
+		// Compare our ranges with their replicas and sync what differs
+		antiEntropy(n)
+
+		// Then hand off the keys we are not an owner of anymore
+		rebalance(n)
 	}
 }
 
@@ -282,7 +214,7 @@ func getAllPredecessors(ring *chord.Ring, key []byte) []string {
 	}
 
 	// Call lookup to get the closest nodes
-	successors, err := ring.Lookup(8, key)
+	successors, err := ring.Lookup(lookupWidth(ring), key)
 	if err != nil {
 		log.Printf("Lookup failed: %v", err)
 	}
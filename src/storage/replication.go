@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	common "commons"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	replicationMutex sync.RWMutex
+	replication      = common.ReplicationConfig{Replicas: defaultReplicas, ReadQuorum: 2, WriteQuorum: 2}
+
+	// Wakes up the replication loop so it adds or removes replicas right away
+	replicationChanged = make(chan struct{}, 1)
+)
+
+func currentReplication() common.ReplicationConfig {
+	replicationMutex.RLock()
+	defer replicationMutex.RUnlock()
+	return replication
+}
+
+func replicaCount() int {
+	return currentReplication().Replicas
+}
+
+func readQuorum() int {
+	return currentReplication().ReadQuorum
+}
+
+func writeQuorum() int {
+	return currentReplication().WriteQuorum
+}
+
+// maxReplicas is bounded by how many successors a lookup can return
+func maxReplicas() int {
+	if ring != nil {
+		return ring.Config.NumSuccessors
+	}
+	return chord.DefaultConfig("").NumSuccessors
+}
+
+func validateReplication(config common.ReplicationConfig) error {
+	if config.Replicas <= 0 || config.Replicas > maxReplicas() {
+		return fmt.Errorf("replicas must be between 1 and %d", maxReplicas())
+	}
+	if config.ReadQuorum <= 0 || config.ReadQuorum > config.Replicas {
+		return fmt.Errorf("read_quorum must be between 1 and %d", config.Replicas)
+	}
+	if config.WriteQuorum <= 0 || config.WriteQuorum > config.Replicas {
+		return fmt.Errorf("write_quorum must be between 1 and %d", config.Replicas)
+	}
+	return nil
+}
+
+// The setting is kept out of the top level of the data directory, every JSON
+// file there is a product
+func replicationPath() string {
+	return filepath.Join(addr, "config", "replication.json")
+}
+
+// migrateReplicationConfig moves the setting from where older versions kept it.
+// A product named replication may have replaced it, that one is left alone.
+func migrateReplicationConfig() {
+	legacy := filepath.Join(addr, "replication.json")
+	data, err := os.ReadFile(legacy)
+	if err != nil {
+		return
+	}
+
+	var config common.ReplicationConfig
+	if json.Unmarshal(data, &config) != nil || validateReplication(config) != nil {
+		return
+	}
+	if _, err := os.Stat(replicationPath()); err == nil {
+		os.Remove(legacy)
+		return
+	}
+
+	if err := writeFileAtomic(replicationPath(), data); err != nil {
+		log.Printf("Failed to move the replication config: %v", err)
+		return
+	}
+	os.Remove(legacy)
+}
+
+// loadQuorumConfig reads N, R and W from the environment, quorums can't be
+// bigger than the number of replicas. A setting changed through the admin API
+// is loaded later by loadReplicationConfig and takes precedence.
+func loadQuorumConfig() {
+	config := common.ReplicationConfig{
+		Replicas:    envInt("REPLICAS", defaultReplicas),
+		ReadQuorum:  envInt("READ_QUORUM", 2),
+		WriteQuorum: envInt("WRITE_QUORUM", 2),
+	}
+
+	if config.Replicas > maxReplicas() {
+		config.Replicas = maxReplicas()
+	}
+	if config.ReadQuorum > config.Replicas {
+		config.ReadQuorum = config.Replicas
+	}
+	if config.WriteQuorum > config.Replicas {
+		config.WriteQuorum = config.Replicas
+	}
+
+	replicationMutex.Lock()
+	replication = config
+	replicationMutex.Unlock()
+
+	log.Printf("Quorum configuration N=%d R=%d W=%d", config.Replicas, config.ReadQuorum, config.WriteQuorum)
+}
+
+// loadReplicationConfig restores the setting this node had before restarting
+func loadReplicationConfig() {
+	migrateReplicationConfig()
+
+	data, err := os.ReadFile(replicationPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read the replication config: %v", err)
+		return
+	}
+
+	var config common.ReplicationConfig
+	if err := json.Unmarshal(data, &config); err != nil || validateReplication(config) != nil {
+		log.Printf("Ignoring invalid replication config %s", replicationPath())
+		return
+	}
+
+	replicationMutex.Lock()
+	replication = config
+	replicationMutex.Unlock()
+
+	log.Printf("Restored quorum configuration N=%d R=%d W=%d", config.Replicas, config.ReadQuorum, config.WriteQuorum)
+}
+
+// applyReplication adopts the config if it is newer than ours and persists it.
+// It returns whether it was adopted.
+func applyReplication(config common.ReplicationConfig) (bool, error) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	if config.Version.Compare(replication.Version) <= 0 {
+		return false, nil
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := walWrite(replicationPath(), data); err != nil {
+		return false, err
+	}
+
+	previous := replication
+	replication = config
+	log.Printf("Quorum configuration changed from N=%d R=%d W=%d to N=%d R=%d W=%d",
+		previous.Replicas, previous.ReadQuorum, previous.WriteQuorum, config.Replicas, config.ReadQuorum, config.WriteQuorum)
+
+	select {
+	case replicationChanged <- struct{}{}:
+	default:
+	}
+
+	return true, nil
+}
+
+func sendReplication(config common.ReplicationConfig, host string) error {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	resp, err := antiEntropyClient.Post("http://"+httpAddress(host)+"/admin/replication/apply", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// replicationHandler shows the replication setting or changes it for the whole
+// cluster. Quorums left out of a change default to a majority of the replicas.
+func replicationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var config common.ReplicationConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if config.ReadQuorum == 0 {
+			config.ReadQuorum = config.Replicas/2 + 1
+		}
+		if config.WriteQuorum == 0 {
+			config.WriteQuorum = config.Replicas/2 + 1
+		}
+		if err := validateReplication(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		config.Version = clock.Now()
+		if _, err := applyReplication(config); err != nil {
+			log.Printf("Failed to apply the replication config: %v", err)
+			http.Error(w, "Failed to apply the replication config", http.StatusInternalServerError)
+			return
+		}
+
+		// Nodes that miss it now learn it on their next sync
+		for _, host := range clusterHosts(ring) {
+			if host == addr {
+				continue
+			}
+			if err := sendReplication(config, host); err != nil {
+				log.Printf("Failed to send the replication config to %s: %v", host, err)
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentReplication())
+}
+
+// replicationApplyHandler receives the setting from the node where it was changed
+func replicationApplyHandler(w http.ResponseWriter, r *http.Request) {
+	var config common.ReplicationConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if err := validateReplication(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clock.Observe(config.Version)
+	if _, err := applyReplication(config); err != nil {
+		log.Printf("Failed to apply the replication config: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// syncReplication adopts the newest setting known by the rest of the cluster, so
+// nodes that were down or joined later converge
+func syncReplication(ring *chord.Ring) {
+	for _, host := range clusterHosts(ring) {
+		if host == addr {
+			continue
+		}
+
+		var config common.ReplicationConfig
+		if err := getJSON("http://"+httpAddress(host)+"/admin/replication", &config); err != nil {
+			continue
+		}
+		if validateReplication(config) != nil {
+			continue
+		}
+
+		clock.Observe(config.Version)
+		if _, err := applyReplication(config); err != nil {
+			log.Printf("Failed to apply the replication config of %s: %v", host, err)
+		}
+	}
+}
+
+func ReplicationSync(ring *chord.Ring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		syncReplication(ring)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicationConfigValidate(t *testing.T) {
+	if err := validateReplication(common.ReplicationConfig{Replicas: 5, ReadQuorum: 3, WriteQuorum: 3}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	invalid := []common.ReplicationConfig{
+		{Replicas: 0, ReadQuorum: 1, WriteQuorum: 1},
+		{Replicas: maxReplicas() + 1, ReadQuorum: 1, WriteQuorum: 1},
+		{Replicas: 3, ReadQuorum: 4, WriteQuorum: 2},
+		{Replicas: 3, ReadQuorum: 2, WriteQuorum: 0},
+	}
+	for _, config := range invalid {
+		if err := validateReplication(config); err == nil {
+			t.Fatalf("expected %+v to be invalid", config)
+		}
+	}
+}
+
+func TestApplyReplicationKeepsNewest(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer loadQuorumConfig()
+
+	newer := common.ReplicationConfig{Replicas: 5, ReadQuorum: 3, WriteQuorum: 3, Version: common.Version{WallTime: 2, Node: "a"}}
+	older := common.ReplicationConfig{Replicas: 2, ReadQuorum: 1, WriteQuorum: 1, Version: common.Version{WallTime: 1, Node: "b"}}
+
+	if applied, err := applyReplication(newer); err != nil || !applied {
+		t.Fatalf("expected the config to be applied, %v", err)
+	}
+	if applied, err := applyReplication(older); err != nil || applied {
+		t.Fatalf("expected the older config to be ignored, %v", err)
+	}
+	if replicaCount() != 5 || readQuorum() != 3 || writeQuorum() != 3 {
+		t.Fatalf("unexpected config %+v", currentReplication())
+	}
+
+	// The config survives a restart
+	loadQuorumConfig()
+	loadReplicationConfig()
+	if replicaCount() != 5 {
+		t.Fatalf("expected the config to be restored, got %+v", currentReplication())
+	}
+}
+
+func TestReplicationConfigIsNotAProduct(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer loadQuorumConfig()
+
+	// Older versions kept the setting next to the products
+	legacy := common.ReplicationConfig{Replicas: 3, ReadQuorum: 2, WriteQuorum: 2, Version: common.Version{WallTime: 1, Node: "a"}}
+	data, _ := json.Marshal(legacy)
+	os.WriteFile(filepath.Join(addr, "replication.json"), data, 0644)
+
+	loadReplicationConfig()
+
+	if replicaCount() != 3 {
+		t.Fatalf("expected the setting to be restored, got N=%d", replicaCount())
+	}
+	if names, _ := listProductNames(); len(names) != 0 {
+		t.Fatalf("expected no products, got %v", names)
+	}
+}
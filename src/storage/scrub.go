@@ -0,0 +1,80 @@
+package main
+
+import (
+	"chord"
+	"errors"
+	"log"
+	"time"
+)
+
+// scrub reads every local product and repairs the ones that don't match their
+// checksum or can't be decoded anymore
+func scrub(ring *chord.Ring) {
+	names, err := listProductNames()
+	if err != nil {
+		log.Printf("Failed to list products: %v", err)
+		return
+	}
+
+	corrupt, repaired := 0, 0
+	for _, name := range names {
+		_, _, err := readProduct(name)
+		if err == nil || !errors.Is(err, errCorrupt) {
+			continue
+		}
+
+		corrupt++
+		log.Printf("Scrubber found %s corrupt: %v", name, err)
+
+		if repairProduct(ring, name) {
+			repaired++
+		}
+	}
+
+	if corrupt > 0 {
+		log.Printf("Scrubber repaired %d of %d corrupt products", repaired, corrupt)
+	}
+}
+
+// repairProduct replaces the local copy with the first healthy one found among
+// the owners of the key
+func repairProduct(ring *chord.Ring, name string) bool {
+	owners, err := ownersOf(ring, name, replicaCount())
+	if err != nil {
+		log.Printf("Lookup failed for %s: %v", name, err)
+		return false
+	}
+
+	for _, owner := range owners {
+		if owner == addr {
+			continue
+		}
+
+		// fetchFromReplica already rejects copies that don't match their checksum
+		product, found, err := fetchFromReplica(owner, name)
+		if err != nil || !found {
+			continue
+		}
+
+		product.Replicated = len(owners) == 0 || owners[0] != addr
+		if _, err := storeProduct(product); err != nil {
+			log.Printf("Failed to store the repaired copy of %s: %v", name, err)
+			return false
+		}
+
+		log.Printf("Repaired %s from %s", name, owner)
+		return true
+	}
+
+	log.Printf("No healthy copy of %s found", name)
+	return false
+}
+
+func Scrub(ring *chord.Ring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		scrub(ring)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "for": true, "from": true, "in": true, "is": true, "it": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true, "with": true,
+}
+
+// Posting is the entry of a document in the posting list of a term. Removed
+// postings are kept so an older update arriving late can't bring them back.
+type Posting struct {
+	Doc     string         `json:"doc"`
+	TF      int            `json:"tf"`
+	Length  int            `json:"length"`
+	Version common.Version `json:"version"`
+	Removed bool           `json:"removed"`
+}
+
+// CorpusStats are the number of indexed documents and their total length in
+// tokens, see corpusDimension
+type CorpusStats struct {
+	Docs   int `json:"docs"`
+	Length int `json:"length"`
+}
+
+var indexMutex sync.Mutex
+
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	tokens := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if len(field) < 2 || stopWords[field] {
+			continue
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+func termFrequencies(product common.Product) (map[string]int, int) {
+	tokens := tokenize(product.Name + " " + product.Description)
+
+	frequencies := make(map[string]int)
+	for _, token := range tokens {
+		frequencies[token]++
+	}
+	return frequencies, len(tokens)
+}
+
+func indexDir() string {
+	return filepath.Join(addr, "index")
+}
+
+func termPath(term string) string {
+	return filepath.Join(indexDir(), keyFile(term))
+}
+
+// validTerm tells if the term is one tokenize gives, terms from the network end
+// up in file names
+func validTerm(term string) bool {
+	tokens := tokenize(term)
+	return len(tokens) == 1 && tokens[0] == term
+}
+
+// migrateIndexFiles renames the postings of terms written before the file names
+// were escaped, only terms with letters outside ASCII change
+func migrateIndexFiles() {
+	files, err := os.ReadDir(indexDir())
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		term := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || !validTerm(term) || keyFile(term) == file.Name() {
+			continue
+		}
+		if err := os.Rename(filepath.Join(indexDir(), file.Name()), termPath(term)); err != nil {
+			log.Printf("Failed to migrate the postings of %s: %v", term, err)
+		}
+	}
+}
+
+func termOwners(term string) ([]string, error) {
+	return ownersOf(ring, "term:"+term, replicaCount())
+}
+
+func readPostings(term string) (map[string]Posting, error) {
+	postings := make(map[string]Posting)
+
+	data, err := os.ReadFile(termPath(term))
+	if os.IsNotExist(err) {
+		return postings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &postings); err != nil {
+		return nil, err
+	}
+	return postings, nil
+}
+
+// applyPostings merges the postings of a term, the newest version of every
+// document wins
+func applyPostings(term string, updates []Posting) error {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	postings, err := readPostings(term)
+	if err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		if current, ok := postings[update.Doc]; ok && current.Version.Compare(update.Version) > 0 {
+			continue
+		}
+		postings[update.Doc] = update
+	}
+
+	data, err := json.Marshal(postings)
+	if err != nil {
+		return err
+	}
+
+	return walWrite(termPath(term), data)
+}
+
+// indexProduct sends the postings of the product to the owners of its terms. The
+// terms the previous version had and the new one doesn't are removed.
+func indexProduct(product common.Product, previous *common.Product) {
+	frequencies, length := termFrequencies(product)
+
+	updates := make(map[string][]Posting)
+	for term, tf := range frequencies {
+		updates[term] = append(updates[term], Posting{Doc: product.Name, TF: tf, Length: length, Version: product.Version})
+	}
+
+	if previous != nil {
+		old, _ := termFrequencies(*previous)
+		for term := range old {
+			if _, ok := frequencies[term]; !ok {
+				updates[term] = append(updates[term], Posting{Doc: product.Name, Version: product.Version, Removed: true})
+			}
+		}
+	}
+
+	sendPostings(updates)
+}
+
+// unindexProduct removes every posting of a deleted product
+func unindexProduct(product common.Product, version common.Version) {
+	frequencies, _ := termFrequencies(product)
+
+	updates := make(map[string][]Posting)
+	for term := range frequencies {
+		updates[term] = append(updates[term], Posting{Doc: product.Name, Version: version, Removed: true})
+	}
+
+	sendPostings(updates)
+}
+
+// sendPostings groups the updates by the hosts owning each term and sends one
+// request per host
+func sendPostings(updates map[string][]Posting) {
+	batches := make(map[string]map[string][]Posting)
+	for term, postings := range updates {
+		owners, err := termOwners(term)
+		if err != nil {
+			log.Printf("Lookup failed for term %s: %v", term, err)
+			continue
+		}
+
+		for _, owner := range owners {
+			if batches[owner] == nil {
+				batches[owner] = make(map[string][]Posting)
+			}
+			batches[owner][term] = postings
+		}
+	}
+
+	for owner, batch := range batches {
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			log.Printf("Failed to marshal postings: %v", err)
+			continue
+		}
+
+		resp, err := antiEntropyClient.Post("http://"+httpAddress(owner)+"/index", "application/json", bytes.NewBuffer(payload))
+		if err != nil {
+			log.Printf("Failed to send postings to %s: %v", owner, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Unexpected status sending postings to %s: %v", owner, resp.StatusCode)
+		}
+	}
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		term := r.URL.Query().Get("term")
+		if !validTerm(term) {
+			http.Error(w, "Invalid term", http.StatusBadRequest)
+			return
+		}
+
+		postings, err := readPostings(term)
+		if err != nil {
+			http.Error(w, "Failed to read postings", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(postings)
+	case http.MethodPost:
+		var batch map[string][]Posting
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		for term := range batch {
+			if !validTerm(term) {
+				http.Error(w, "Invalid term", http.StatusBadRequest)
+				return
+			}
+		}
+
+		for term, postings := range batch {
+			if err := applyPostings(term, postings); err != nil {
+				log.Printf("Failed to apply postings of %s: %v", term, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// fetchPostings asks the owners of the term for its postings, the first one
+// answering is enough
+func fetchPostings(term string) (map[string]Posting, error) {
+	owners, err := termOwners(term)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, owner := range owners {
+		var postings map[string]Posting
+		err := getJSON("http://"+httpAddress(owner)+"/index?term="+url.QueryEscape(term), &postings)
+		if err != nil {
+			log.Printf("Failed to fetch postings of %s from %s: %v", term, owner, err)
+			continue
+		}
+		return postings, nil
+	}
+
+	return nil, fmt.Errorf("no owner of term %s answered", term)
+}
+
+func livePostings(postings map[string]Posting) map[string]Posting {
+	live := make(map[string]Posting, len(postings))
+	for doc, posting := range postings {
+		if !posting.Removed {
+			live[doc] = posting
+		}
+	}
+	return live
+}
+
+// search fetches the postings of the query terms from their owners and ranks them
+// with the statistics of the whole cluster
+func search(query string, limit int) ([]common.SearchResult, error) {
+	corpus := clusterCounts()[corpusDimension]
+	stats := CorpusStats{Docs: corpus[corpusDocs], Length: corpus[corpusLength]}
+
+	terms := make(map[string]map[string]Posting)
+	for _, term := range tokenize(query) {
+		if _, ok := terms[term]; ok {
+			continue
+		}
+
+		postings, err := fetchPostings(term)
+		if err != nil {
+			return nil, err
+		}
+		terms[term] = postings
+	}
+
+	return rankBM25(stats, terms, limit), nil
+}
+
+// rankBM25 scores the documents matching any of the terms with BM25
+func rankBM25(stats CorpusStats, terms map[string]map[string]Posting, limit int) []common.SearchResult {
+	if stats.Docs == 0 || stats.Length == 0 {
+		return []common.SearchResult{}
+	}
+
+	n := float64(stats.Docs)
+	avgLength := float64(stats.Length) / n
+
+	scores := make(map[string]float64)
+	for _, postings := range terms {
+		postings = livePostings(postings)
+
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		for doc, posting := range postings {
+			tf := float64(posting.TF)
+			norm := 1 - bm25B + bm25B*float64(posting.Length)/avgLength
+			scores[doc] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	results := make([]common.SearchResult, 0, len(scores))
+	for doc, score := range scores {
+		results = append(results, common.SearchResult{Key: doc, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Key < results[j].Key
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+
+	limit := 10
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := search(q, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Attach the products so the client doesn't need another round trip
+	live := make([]common.SearchResult, 0, len(results))
+	for _, result := range results {
+		owners, err := ownersOf(ring, result.Key, replicaCount())
+		if err == nil {
+			for _, owner := range owners {
+				product, found, err := fetchFromReplica(owner, result.Key)
+				if err == nil && found {
+					result.Product = &product
+					break
+				}
+			}
+		}
+
+		// The index may still point to products deleted a moment ago
+		if result.Product != nil && result.Product.Deleted {
+			continue
+		}
+		live = append(live, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(live)
+}
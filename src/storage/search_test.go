@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("The MSI GeForce RTX-4060, 8GB of GDDR6")
+	expected := []string{"msi", "geforce", "rtx", "4060", "8gb", "gddr6"}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Fatalf("unexpected tokens %v", tokens)
+		}
+	}
+}
+
+func postingsOf(products ...common.Product) (CorpusStats, map[string]map[string]Posting) {
+	var stats CorpusStats
+	terms := make(map[string]map[string]Posting)
+	for _, product := range products {
+		frequencies, length := termFrequencies(product)
+		stats.Docs++
+		stats.Length += length
+		for term, tf := range frequencies {
+			if terms[term] == nil {
+				terms[term] = make(map[string]Posting)
+			}
+			terms[term][product.Name] = Posting{Doc: product.Name, TF: tf, Length: length}
+		}
+	}
+	return stats, terms
+}
+
+func TestRankBM25(t *testing.T) {
+	docs, terms := postingsOf(
+		common.Product{Name: "rtx 4060", Description: "graphics card"},
+		common.Product{Name: "rtx 4090", Description: "rtx graphics card with rtx"},
+		common.Product{Name: "ssd", Description: "fast storage"},
+	)
+
+	query := map[string]map[string]Posting{"rtx": terms["rtx"]}
+	results := rankBM25(docs, query, 10)
+
+	if len(results) != 2 {
+		t.Fatalf("expected two results, got %v", results)
+	}
+	if results[0].Key != "rtx 4090" {
+		t.Fatalf("expected the document with more occurrences first, got %v", results)
+	}
+}
+
+func TestRankBM25SkipsRemoved(t *testing.T) {
+	docs, terms := postingsOf(common.Product{Name: "rtx 4060"}, common.Product{Name: "rtx 4070"})
+
+	removed := terms["rtx"]["rtx 4070"]
+	removed.Removed = true
+	terms["rtx"]["rtx 4070"] = removed
+
+	results := rankBM25(docs, map[string]map[string]Posting{"rtx": terms["rtx"]}, 10)
+	if len(results) != 1 || results[0].Key != "rtx 4060" {
+		t.Fatalf("unexpected results %v", results)
+	}
+}
+
+func TestIndexHandlerRejectsTraversalTerm(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	payload, _ := json.Marshal(map[string][]Posting{"../victim": {{Doc: "product", TF: 1, Length: 1}}})
+	recorder := httptest.NewRecorder()
+	indexHandler(recorder, httptest.NewRequest(http.MethodPost, "/index", bytes.NewReader(payload)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected the term to be rejected, got %d", recorder.Code)
+	}
+	if names, _ := listProductNames(); len(names) != 0 {
+		t.Fatalf("expected no product to appear, got %v", names)
+	}
+
+	recorder = httptest.NewRecorder()
+	indexHandler(recorder, httptest.NewRequest(http.MethodGet, "/index?term=..%2Fvictim", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected the term to be rejected, got %d", recorder.Code)
+	}
+
+	// Terms outside ASCII are escaped like keys
+	if err := applyPostings("café", []Posting{{Doc: "product", TF: 1, Length: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if postings, err := readPostings("café"); err != nil || len(postings) != 1 {
+		t.Fatalf("expected the postings back, got %v %v", postings, err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Secondary indexes map the value of a field to the keys of the local products
+// that have it, so the common queries don't have to read every product
+const (
+	indexSource    = "source"
+	indexCategory  = "category"
+	indexPriceBand = "price_band"
+)
+
+var indexDimensions = []string{indexSource, indexCategory, indexPriceBand}
+
+// The counts also carry how many documents there are and their total length, the
+// statistics BM25 needs. Each node counts the range it owns, so they are added up
+// like the rest instead of being kept in one place.
+const (
+	corpusDimension = "corpus"
+	corpusDocs      = "docs"
+	corpusLength    = "length"
+)
+
+// PriceBand covers the prices in [Min, Max), a Max of 0 means no upper bound
+type PriceBand struct {
+	Name string
+	Min  float64
+	Max  float64
+}
+
+var priceBands = []PriceBand{
+	{"0-100", 0, 100},
+	{"100-250", 100, 250},
+	{"250-500", 250, 500},
+	{"500-1000", 500, 1000},
+	{"1000+", 1000, 0},
+}
+
+func priceBandOf(price float64) string {
+	for _, band := range priceBands {
+		if price >= band.Min && (band.Max == 0 || price < band.Max) {
+			return band.Name
+		}
+	}
+	return priceBands[0].Name
+}
+
+func isPriceBand(name string) bool {
+	for _, band := range priceBands {
+		if band.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bandsBetween returns the bands that hold at least one price in [min, max], a
+// max of 0 means no upper bound
+func bandsBetween(min float64, max float64) []string {
+	var names []string
+	for _, band := range priceBands {
+		if max > 0 && band.Min > max {
+			continue
+		}
+		if band.Max > 0 && band.Max <= min {
+			continue
+		}
+		names = append(names, band.Name)
+	}
+	return names
+}
+
+// indexedValues returns the value of every dimension for the product, tombstones
+// are not indexed
+func indexedValues(product common.Product) map[string]string {
+	if product.Deleted {
+		return nil
+	}
+
+	return map[string]string{
+		indexSource:    sourceOf(product),
+		indexCategory:  common.CategoryOf(product),
+		indexPriceBand: priceBandOf(product.Price),
+	}
+}
+
+var (
+	secondaryMutex sync.Mutex
+	// dimension -> value -> keys
+	secondary map[string]map[string]map[string]bool
+	// key -> dimension -> value, used to drop the old entries of a key
+	secondaryByKey map[string]map[string]string
+	// key -> number of tokens the search index holds for it
+	secondaryLengths map[string]int
+)
+
+// loadSecondary builds the indexes from disk the first time they are used, the
+// caller must hold secondaryMutex
+func loadSecondary() {
+	if secondary != nil {
+		return
+	}
+
+	secondary = make(map[string]map[string]map[string]bool)
+	secondaryByKey = make(map[string]map[string]string)
+	secondaryLengths = make(map[string]int)
+	for _, dimension := range indexDimensions {
+		secondary[dimension] = make(map[string]map[string]bool)
+	}
+
+	names, err := listProductNames()
+	if err != nil {
+		log.Printf("Failed to list products: %v", err)
+	}
+	for _, name := range names {
+		product, found, err := readProduct(name)
+		if err != nil || !found {
+			continue
+		}
+		addSecondary(product)
+	}
+}
+
+func addSecondary(product common.Product) {
+	values := indexedValues(product)
+	if values == nil {
+		return
+	}
+
+	for dimension, value := range values {
+		keys, ok := secondary[dimension][value]
+		if !ok {
+			keys = make(map[string]bool)
+			secondary[dimension][value] = keys
+		}
+		keys[product.Name] = true
+	}
+	secondaryByKey[product.Name] = values
+	_, secondaryLengths[product.Name] = termFrequencies(product)
+}
+
+func dropSecondary(name string) {
+	for dimension, value := range secondaryByKey[name] {
+		delete(secondary[dimension][value], name)
+		if len(secondary[dimension][value]) == 0 {
+			delete(secondary[dimension], value)
+		}
+	}
+	delete(secondaryByKey, name)
+	delete(secondaryLengths, name)
+}
+
+// recordSecondary replaces the entries of the product, it is called by storeProduct
+// for local inserts and replicated writes alike
+func recordSecondary(product common.Product) {
+	secondaryMutex.Lock()
+	defer secondaryMutex.Unlock()
+
+	if secondary == nil {
+		return
+	}
+	dropSecondary(product.Name)
+	addSecondary(product)
+}
+
+func forgetSecondary(name string) {
+	secondaryMutex.Lock()
+	defer secondaryMutex.Unlock()
+
+	if secondary == nil {
+		return
+	}
+	dropSecondary(name)
+}
+
+// secondaryLookup returns the keys that have any of the values in the dimension
+func secondaryLookup(dimension string, values []string) map[string]bool {
+	secondaryMutex.Lock()
+	defer secondaryMutex.Unlock()
+
+	loadSecondary()
+
+	result := make(map[string]bool)
+	for _, value := range values {
+		for key := range secondary[dimension][value] {
+			result[key] = true
+		}
+	}
+	return result
+}
+
+// secondaryCounts returns how many local products have every value, only the
+// keys accepted by keep are counted
+func secondaryCounts(keep func(key string) bool) map[string]map[string]int {
+	secondaryMutex.Lock()
+	loadSecondary()
+	entries := make(map[string]map[string]string, len(secondaryByKey))
+	for key, values := range secondaryByKey {
+		entries[key] = values
+	}
+	lengths := make(map[string]int, len(secondaryLengths))
+	for key, length := range secondaryLengths {
+		lengths[key] = length
+	}
+	secondaryMutex.Unlock()
+
+	counts := make(map[string]map[string]int)
+	for _, dimension := range indexDimensions {
+		counts[dimension] = make(map[string]int)
+	}
+	counts[corpusDimension] = map[string]int{corpusDocs: 0, corpusLength: 0}
+
+	for key, values := range entries {
+		if !keep(key) {
+			continue
+		}
+		for dimension, value := range values {
+			counts[dimension][value]++
+		}
+		counts[corpusDimension][corpusDocs]++
+		counts[corpusDimension][corpusLength] += lengths[key]
+	}
+	return counts
+}
+
+// candidates narrows the keys a query has to read using the secondary indexes.
+// It returns false when the query has no indexed filter and needs a full scan.
+func (q productQuery) candidates() ([]string, bool) {
+	var sets []map[string]bool
+	if q.Source != "" {
+		sets = append(sets, secondaryLookup(indexSource, []string{q.Source}))
+	}
+	if q.Category != "" {
+		sets = append(sets, secondaryLookup(indexCategory, []string{q.Category}))
+	}
+	if q.PriceBand != "" {
+		sets = append(sets, secondaryLookup(indexPriceBand, []string{q.PriceBand}))
+	}
+	if q.MinPrice > 0 || q.MaxPrice > 0 {
+		sets = append(sets, secondaryLookup(indexPriceBand, bandsBetween(q.MinPrice, q.MaxPrice)))
+	}
+
+	if len(sets) == 0 {
+		return nil, false
+	}
+
+	names := []string{}
+	for key := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if !set[key] {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			names = append(names, key)
+		}
+	}
+	return names, true
+}
+
+func remoteCounts(host string, owner string) (map[string]map[string]int, error) {
+	values := url.Values{}
+	values.Set("scope", "local")
+	values.Set("owner", owner)
+
+	var counts map[string]map[string]int
+	err := getJSON("http://"+httpAddress(host)+"/indexes?"+values.Encode(), &counts)
+	return counts, err
+}
+
+// clusterCounts adds up the counts of every host over the range it is the primary
+// owner of. The ranges of the hosts that don't answer are asked to the rest.
+func clusterCounts() map[string]map[string]int {
+	hosts := clusterHosts(ring)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var partials []map[string]map[string]int
+	var failed []string
+	var answered []string
+
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			counts, err := remoteCounts(host, host)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Index counts from %s failed: %v", host, err)
+				failed = append(failed, host)
+				return
+			}
+			answered = append(answered, host)
+			partials = append(partials, counts)
+		}(host)
+	}
+	wg.Wait()
+
+	// A single replica is enough for the range of a failed host, counting it
+	// more than once would inflate the totals
+	for _, owner := range failed {
+		for _, host := range answered {
+			counts, err := remoteCounts(host, owner)
+			if err != nil {
+				log.Printf("Index counts from %s for the range of %s failed: %v", host, owner, err)
+				continue
+			}
+			partials = append(partials, counts)
+			break
+		}
+	}
+
+	total := make(map[string]map[string]int)
+	for _, dimension := range indexDimensions {
+		total[dimension] = make(map[string]int)
+	}
+	for _, partial := range partials {
+		for dimension, values := range partial {
+			if total[dimension] == nil {
+				total[dimension] = make(map[string]int)
+			}
+			for value, count := range values {
+				total[dimension][value] += count
+			}
+		}
+	}
+	return total
+}
+
+// indexesHandler answers how many products there are for every source, category
+// and price band along with the search statistics, for the whole cluster unless
+// scope=local is given
+func indexesHandler(w http.ResponseWriter, r *http.Request) {
+	var counts map[string]map[string]int
+
+	if r.URL.Query().Get("scope") == "local" {
+		owner := r.URL.Query().Get("owner")
+		counts = secondaryCounts(func(key string) bool {
+			if owner == "" {
+				return true
+			}
+			owners, err := ownersOf(ring, key, 1)
+			return err == nil && len(owners) > 0 && owners[0] == owner
+		})
+	} else {
+		counts = clusterCounts()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		http.Error(w, "Failed to encode indexes", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	common "commons"
+	"reflect"
+	"testing"
+)
+
+func TestPriceBandOf(t *testing.T) {
+	cases := map[float64]string{
+		0:       "0-100",
+		99.99:   "0-100",
+		100:     "100-250",
+		499.99:  "250-500",
+		999:     "500-1000",
+		1000:    "1000+",
+		4299.99: "1000+",
+	}
+	for price, expected := range cases {
+		if band := priceBandOf(price); band != expected {
+			t.Fatalf("expected %s for %v, got %s", expected, price, band)
+		}
+	}
+}
+
+func TestBandsBetween(t *testing.T) {
+	if bands := bandsBetween(0, 100); !reflect.DeepEqual(bands, []string{"0-100", "100-250"}) {
+		t.Fatalf("unexpected bands %v", bands)
+	}
+	if bands := bandsBetween(0, 99); !reflect.DeepEqual(bands, []string{"0-100"}) {
+		t.Fatalf("unexpected bands %v", bands)
+	}
+	if bands := bandsBetween(600, 0); !reflect.DeepEqual(bands, []string{"500-1000", "1000+"}) {
+		t.Fatalf("unexpected bands %v", bands)
+	}
+}
+
+func TestIndexedValues(t *testing.T) {
+	product := common.Product{
+		Name:  "MSI GeForce RTX 4060 Ventus 2X",
+		Price: 299.99,
+		URL:   "https://www.newegg.com/p/N82E16814137797",
+	}
+
+	expected := map[string]string{
+		indexSource:    "newegg",
+		indexCategory:  "gpu",
+		indexPriceBand: "250-500",
+	}
+	if values := indexedValues(product); !reflect.DeepEqual(values, expected) {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	product.Deleted = true
+	if values := indexedValues(product); values != nil {
+		t.Fatalf("tombstones must not be indexed, got %v", values)
+	}
+}
+
+func TestSecondaryCountsCorpus(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+	defer func() { secondary = nil }()
+
+	storeProduct(common.Product{Name: "rtx 4060", Description: "graphics card", Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}})
+	storeProduct(common.Product{Name: "ssd", Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}})
+	storeProduct(common.Product{Name: "gone", Deleted: true, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}})
+
+	secondary = nil
+	corpus := secondaryCounts(func(string) bool { return true })[corpusDimension]
+	if corpus[corpusDocs] != 2 || corpus[corpusLength] != 5 {
+		t.Fatalf("unexpected corpus statistics %v", corpus)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The manifest is the last entry of every snapshot, it holds the checksum of
+// every other entry
+const snapshotManifest = "MANIFEST.json"
+
+type SnapshotManifest struct {
+	Node    string            `json:"node"`
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+// createSnapshot archives the data directory into w. Writes are blocked while it
+// runs so the archive is a consistent point in time.
+func createSnapshot(w io.Writer) (SnapshotManifest, error) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	manifest := SnapshotManifest{Node: addr, Created: time.Now().UTC(), Files: make(map[string]string)}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(addr, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || fp == walPath() || strings.Contains(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		data, err := os.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(addr, fp)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		sum := sha256.Sum256(data)
+		manifest.Files[rel] = hex.EncodeToString(sum[:])
+
+		return writeTarEntry(tw, rel, data, info.ModTime())
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeTarEntry(tw, snapshotManifest, data, manifest.Created); err != nil {
+		return manifest, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// snapshotHandler answers a point in time archive of the node with the checksum
+// of the whole archive in the X-Snapshot-Checksum header
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	// The archive is built in a temporary file so writes are only blocked for as
+	// long as it takes to copy the data, not for as long as the client reads it
+	tmp, err := os.CreateTemp("", "snapshot-*.tar.gz")
+	if err != nil {
+		http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	manifest, err := createSnapshot(io.MultiWriter(tmp, hash))
+	if err != nil {
+		log.Printf("Failed to create snapshot: %v", err)
+		http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	name := fmt.Sprintf("snapshot-%s-%d.tar.gz", strings.ReplaceAll(addr, ":", "_"), manifest.Created.Unix())
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("X-Snapshot-Checksum", hex.EncodeToString(hash.Sum(nil)))
+
+	if _, err := io.Copy(w, tmp); err != nil {
+		log.Printf("Failed to send snapshot: %v", err)
+	}
+
+	log.Printf("Snapshot with %d files sent", len(manifest.Files))
+}
+
+// errDataNotEmpty is returned when restoring into a data directory that already
+// has products, the snapshot would overwrite newer versions
+var errDataNotEmpty = errors.New("the data directory already has products")
+
+// restoreSnapshot loads a snapshot into the data directory. Every entry is checked
+// against the manifest before anything is written, so a damaged archive leaves
+// the directory untouched. The files are copied as they are without comparing
+// versions, so it only restores into a directory without products.
+func restoreSnapshot(path string) error {
+	names, err := listProductNames()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(names) > 0 {
+		return errDataNotEmpty
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	var manifest *SnapshotManifest
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("invalid entry %s", header.Name)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		if header.Name == snapshotManifest {
+			manifest = &SnapshotManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return fmt.Errorf("invalid manifest: %v", err)
+			}
+			continue
+		}
+		files[header.Name] = data
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("snapshot has no manifest")
+	}
+	if len(files) != len(manifest.Files) {
+		return fmt.Errorf("snapshot has %d files but the manifest lists %d", len(files), len(manifest.Files))
+	}
+
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		if expected, ok := manifest.Files[name]; !ok || expected != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	for name, data := range files {
+		if err := writeFileAtomic(filepath.Join(addr, filepath.FromSlash(name)), data); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Restored %d files from the snapshot of %s taken at %s", len(files), manifest.Node, manifest.Created.Format(time.RFC3339))
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	os.WriteFile(filepath.Join(addr, "product.json"), []byte(`{"name":"product"}`), 0644)
+	os.MkdirAll(filepath.Join(addr, "history"), os.ModePerm)
+	os.WriteFile(filepath.Join(addr, "history", "product.json"), []byte(`[]`), 0644)
+
+	var archive bytes.Buffer
+	manifest, err := createSnapshot(&archive)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Fatalf("expected two files, got %v", manifest.Files)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	os.WriteFile(path, archive.Bytes(), 0644)
+
+	addr = t.TempDir()
+	if err := restoreSnapshot(path); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(addr, "history", "product.json"))
+	if err != nil || string(data) != "[]" {
+		t.Fatalf("expected the history to be restored, got %s %v", data, err)
+	}
+}
+
+func TestSnapshotRejectsCorruption(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	os.WriteFile(filepath.Join(addr, "product.json"), []byte(`{"name":"product"}`), 0644)
+
+	var archive bytes.Buffer
+	if _, err := createSnapshot(&archive); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	data := archive.Bytes()
+	data[len(data)/2] ^= 0xff
+
+	path := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	os.WriteFile(path, data, 0644)
+
+	addr = t.TempDir()
+	if err := restoreSnapshot(path); err == nil {
+		t.Fatalf("expected a corrupted snapshot to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(addr, "product.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be restored")
+	}
+}
+
+func TestSnapshotRefusesDataDirWithProducts(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	os.WriteFile(filepath.Join(addr, "product.json"), []byte(`{"name":"product","price":10}`), 0644)
+
+	var archive bytes.Buffer
+	if _, err := createSnapshot(&archive); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	os.WriteFile(path, archive.Bytes(), 0644)
+
+	// The node got a newer version since the snapshot was taken
+	os.WriteFile(filepath.Join(addr, "product.json"), []byte(`{"name":"product","price":12}`), 0644)
+
+	if err := restoreSnapshot(path); err != errDataNotEmpty {
+		t.Fatalf("expected the restore to be refused, got %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(addr, "product.json"))
+	if string(data) != `{"name":"product","price":12}` {
+		t.Fatalf("expected the newer version to be kept, got %s", data)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var storeMutex sync.Mutex
+
+var errCorrupt = errors.New("checksum mismatch")
+
+// keyFile is the file name a key is stored under. Keys are escaped so a name
+// with a path separator or ".." can't leave the directory it is stored in.
+func keyFile(name string) string {
+	return url.PathEscape(name) + ".json"
+}
+
+// keyOfFile is the key stored in the file, the reverse of keyFile
+func keyOfFile(file string) (string, bool) {
+	if filepath.Ext(file) != ".json" {
+		return "", false
+	}
+	name, err := url.PathUnescape(strings.TrimSuffix(file, ".json"))
+	return name, err == nil
+}
+
+// validKey tells if a key can be written by clients, path separators are
+// rejected so keys read the same on every node
+func validKey(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\")
+}
+
+func productPath(name string) string {
+	return filepath.Join(addr, keyFile(name))
+}
+
+// readProduct returns the local copy of a product and whether it exists
+func readProduct(name string) (common.Product, bool, error) {
+	var product common.Product
+
+	data, err := os.ReadFile(productPath(name))
+	if os.IsNotExist(err) {
+		return product, false, nil
+	}
+	if err != nil {
+		return product, false, err
+	}
+
+	if err := json.Unmarshal(data, &product); err != nil {
+		return product, false, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+
+	if !common.VerifyChecksum(product) {
+		return product, false, errCorrupt
+	}
+
+	// Records written with an older schema are upgraded in memory, they are
+	// rewritten with the new layout the next time they change
+	return common.UpgradeProduct(product), true, nil
+}
+
+// storeProduct writes the product unless the local copy is at least as new.
+// It returns whether the product was written.
+func storeProduct(product common.Product) (bool, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	// Nodes running an older version may still send the old layout
+	product = common.UpgradeProduct(product)
+
+	current, found, err := readProduct(product.Name)
+	if err != nil {
+		// An unreadable local copy is always replaced
+		found = false
+	}
+
+	if found && current.Version.Compare(product.Version) >= 0 {
+		return false, nil
+	}
+
+	product.Checksum = common.ProductChecksum(product)
+
+	data, err := json.MarshalIndent(product, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	var previous *common.Product
+	if found {
+		previous = &current
+	}
+
+	if err := writeProductChange(productPath(product.Name), data, product, previous); err != nil {
+		return false, err
+	}
+
+	recordDigest(product)
+	recordSecondary(product)
+
+	onProductStored(product, previous)
+
+	return true, nil
+}
+
+// removeProduct deletes the local copy of the product unless a newer version
+// was written in the meantime, it returns whether the copy was removed
+func removeProduct(product common.Product) (bool, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	current, found, err := readProduct(product.Name)
+	if err == nil && !found {
+		return false, nil
+	}
+	if err == nil && current.Version.Compare(product.Version) > 0 {
+		return false, nil
+	}
+
+	if err := walRemove(productPath(product.Name)); err != nil {
+		return false, err
+	}
+
+	forgetDigest(product.Name)
+	forgetSecondary(product.Name)
+
+	return true, nil
+}
+
+// onProductStored runs after a newer version of a product was written locally
+func onProductStored(product common.Product, previous *common.Product) {
+	// The primary owner keeps the search index up to date, replicas would only
+	// do the same work again. Price alerts are raised by insertHandler.
+	if product.Replicated {
+		return
+	}
+
+	if !product.Deleted {
+		go indexProduct(product, previous)
+	} else if previous != nil && !previous.Deleted {
+		go unindexProduct(*previous, product.Version)
+	}
+}
+
+// listProductNames returns the keys of every product stored in this node
+func listProductNames() ([]string, error) {
+	files, err := os.ReadDir(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if name, ok := keyOfFile(file.Name()); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// migrateProductFiles renames the products stored before keys were escaped,
+// together with their history and archive manifest. The name is read from the
+// product itself since the old file names can't be told apart from escaped ones.
+func migrateProductFiles() {
+	files, err := os.ReadDir(addr)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		var product common.Product
+		data, err := os.ReadFile(filepath.Join(addr, file.Name()))
+		if err != nil || json.Unmarshal(data, &product) != nil || product.Name == "" {
+			continue
+		}
+		if keyFile(product.Name) == file.Name() {
+			continue
+		}
+
+		legacy := strings.TrimSuffix(file.Name(), ".json")
+		moves := [][2]string{
+			{filepath.Join(historyDir(), file.Name()), historyPath(product.Name)},
+			{filepath.Join(manifestsDir(), file.Name()), manifestPath(product.Name)},
+			{filepath.Join(addr, file.Name()), productPath(product.Name)},
+		}
+		for _, move := range moves {
+			if err := os.Rename(move[0], move[1]); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to migrate %s: %v", legacy, err)
+			}
+		}
+		log.Printf("Migrated %s to %s", legacy, keyFile(product.Name))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	common "commons"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStoreProductKeepsNewest(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	newer := common.Product{Name: "product", Price: 10, Replicated: true, Version: common.Version{WallTime: 2, Node: "a"}}
+	older := common.Product{Name: "product", Price: 20, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}}
+
+	if written, err := storeProduct(newer); err != nil || !written {
+		t.Fatalf("expected the product to be written, %v", err)
+	}
+	if written, err := storeProduct(older); err != nil || written {
+		t.Fatalf("expected the older product to be ignored, %v", err)
+	}
+
+	product, found, err := readProduct("product")
+	if err != nil || !found || product.Price != 10 {
+		t.Fatalf("unexpected product %+v %v", product, err)
+	}
+}
+
+func TestReadProductDetectsCorruption(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	product := common.Product{Name: "product", Price: 10, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}}
+	if _, err := storeProduct(product); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	data, _ := os.ReadFile(productPath("product"))
+	os.WriteFile(productPath("product"), []byte(strings.Replace(string(data), "10", "99", 1)), 0644)
+
+	if _, _, err := readProduct("product"); !errors.Is(err, errCorrupt) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	os.WriteFile(productPath("product"), data[:len(data)/2], 0644)
+	if _, _, err := readProduct("product"); !errors.Is(err, errCorrupt) {
+		t.Fatalf("expected a truncated file to be reported as corrupt, got %v", err)
+	}
+}
+
+func TestChecksumIgnoresReplicatedFlag(t *testing.T) {
+	primary := common.Product{Name: "product", Price: 10}
+	replica := primary
+	replica.Replicated = true
+
+	if common.ProductChecksum(primary) != common.ProductChecksum(replica) {
+		t.Fatalf("expected the same checksum on every copy")
+	}
+}
+
+func TestReadProductUpgradesOldSchema(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	// A record as written before the schema was versioned, its checksum covers
+	// the old layout
+	hashed := `{"name":"product","price":299.99,"url":"https://www.newegg.com/p/N82E16814137797","description":"","rating":"Rating + 4.5","node_author":"a","replicated":false,"version":{"wall_time":1700000000000,"logical":0,"node":"a"}}`
+	sum := sha256.Sum256([]byte(hashed))
+	legacy := strings.Replace(hashed, `"replicated":false,`, `"replicated":true,`, 1)
+	legacy = strings.TrimSuffix(legacy, "}") + `,"checksum":"` + hex.EncodeToString(sum[:]) + `"}`
+	os.WriteFile(productPath("product"), []byte(legacy), 0644)
+
+	product, found, err := readProduct("product")
+	if err != nil || !found {
+		t.Fatalf("expected the legacy product to be read, %v", err)
+	}
+
+	if product.SchemaVersion != common.SchemaVersion || product.Source != "newegg" || product.SKU != "N82E16814137797" ||
+		product.RatingValue != 4.5 || product.Availability != common.InStock || product.Currency != "USD" || product.ScrapedAt.IsZero() {
+		t.Fatalf("unexpected upgraded product %+v", product)
+	}
+	if !common.VerifyChecksum(product) {
+		t.Fatalf("expected the upgraded product to carry a valid checksum")
+	}
+
+	// Old records are still checked
+	os.WriteFile(productPath("product"), []byte(strings.Replace(legacy, "299.99", "199.99", 1)), 0644)
+	if _, _, err := readProduct("product"); !errors.Is(err, errCorrupt) {
+		t.Fatalf("expected a corrupt legacy record to be detected, got %v", err)
+	}
+
+	// Nor does pretending a record is old skip the check
+	product.SchemaVersion = 0
+	if common.VerifyChecksum(product) {
+		t.Fatal("expected a record with a changed schema version to fail the check")
+	}
+}
+
+func TestProductPathStaysInDataDir(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	for _, name := range []string{"../outside", "a/b", "Foo Bar 50%"} {
+		product := common.Product{Name: name, Replicated: true, Version: common.Version{WallTime: 1, Node: "a"}}
+		if _, err := storeProduct(product); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	names, err := listProductNames()
+	if err != nil || len(names) != 3 {
+		t.Fatalf("expected every product to be listed, got %v %v", names, err)
+	}
+	if _, err := os.Stat(addr + "/../outside.json"); !os.IsNotExist(err) {
+		t.Fatal("a product was written outside the data directory")
+	}
+	if validKey("a/b") || !validKey("Foo Bar") {
+		t.Fatal("unexpected key validation")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	common "commons"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How long tombstones are kept before being collected, replicas that were down
+// for longer than this may bring deleted products back
+var tombstoneGrace = 24 * time.Hour
+
+func loadTombstoneConfig() {
+	raw := os.Getenv("TOMBSTONE_GRACE")
+	if raw == "" {
+		return
+	}
+
+	grace, err := time.ParseDuration(raw)
+	if err != nil || grace <= 0 {
+		log.Printf("Invalid TOMBSTONE_GRACE %s, using %s", raw, tombstoneGrace)
+		return
+	}
+	tombstoneGrace = grace
+}
+
+func newTombstone(key string) common.Product {
+	tombstone := common.Product{
+		SchemaVersion: common.SchemaVersion,
+		Name:          key,
+		Deleted:       true,
+		Version:       clock.Now(),
+	}
+	tombstone.Checksum = common.ProductChecksum(tombstone)
+	return tombstone
+}
+
+func tombstoneExpired(product common.Product, now time.Time) bool {
+	deletedAt := time.UnixMilli(product.Version.WallTime)
+	return product.Deleted && now.Sub(deletedAt) > tombstoneGrace
+}
+
+// deleteHandler writes a tombstone for the key on its owners, it succeeds after
+// W of them acknowledge it like any other write
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+	if !validKey(key) {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	tombstone := newTombstone(key)
+	acks := insertInStore(ring, tombstone, addr, replicaCount())
+
+	if acks < writeQuorum() {
+		http.Error(w, fmt.Sprintf("Write quorum not reached: %d/%d acknowledgements", acks, writeQuorum()), http.StatusServiceUnavailable)
+		return
+	}
+
+	response := struct {
+		Key     string         `json:"key"`
+		Version common.Version `json:"version"`
+		Acks    int            `json:"acks"`
+	}{
+		Key:     key,
+		Version: tombstone.Version,
+		Acks:    acks,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// collectTombstones removes the tombstones older than the grace period together
+// with the history of the product
+func collectTombstones() {
+	names, err := listProductNames()
+	if err != nil {
+		log.Printf("Failed to list products: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		product, found, err := readProduct(name)
+		if err != nil || !found || !tombstoneExpired(product, now) {
+			continue
+		}
+
+		if collectTombstone(product) {
+			log.Printf("Collected tombstone of %s", name)
+		}
+	}
+}
+
+// collectTombstone removes the tombstone and the history of the product, unless
+// the product was written again since the tombstone was read. The history
+// belongs to the new version then.
+func collectTombstone(tombstone common.Product) bool {
+	name := tombstone.Name
+
+	removed, err := removeProduct(tombstone)
+	if err != nil {
+		log.Printf("Failed to collect tombstone of %s: %v", name, err)
+		return false
+	}
+	if !removed {
+		return false
+	}
+
+	historyMutex.Lock()
+	err = walRemove(historyPath(name))
+	historyMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to remove the history of %s: %v", name, err)
+	}
+	if err := dropArchive(name); err != nil {
+		log.Printf("Failed to remove the archived history of %s: %v", name, err)
+	}
+	return true
+}
+
+func CollectTombstones(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		collectTombstones()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	common "commons"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCollectTombstoneKeepsReinsertedProduct(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	tombstone := common.Product{Name: "p", Deleted: true, Replicated: true, Version: common.Version{WallTime: 1, Node: "n"}}
+	if _, err := storeProduct(tombstone); err != nil {
+		t.Fatal(err)
+	}
+
+	// The product is inserted again after the collector read the tombstone
+	reinserted := common.Product{Name: "p", Price: 12, Replicated: true, Version: common.Version{WallTime: 2, Node: "n"}}
+	if _, err := storeProduct(reinserted); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := mergeHistory("p", []common.PricePoint{{Time: start, Price: 10}, {Time: start.Add(time.Hour), Price: 12}}); err != nil {
+		t.Fatal(err)
+	}
+	segment := ArchiveSegment{ID: "0a1e", Key: "p", From: start, To: start, Version: common.Version{WallTime: 1, Node: "n"}}
+	if _, err := storeSegment(segment); err != nil {
+		t.Fatal(err)
+	}
+
+	if collectTombstone(tombstone) {
+		t.Fatal("expected the re-inserted product not to be collected")
+	}
+	if product, found, err := readProduct("p"); err != nil || !found || product.Deleted {
+		t.Fatalf("expected the re-inserted product to stay, got %+v %v %v", product, found, err)
+	}
+	if history, err := readHistory("p"); err != nil || len(history) != 1 {
+		t.Fatalf("expected the history to stay, got %+v %v", history, err)
+	}
+	if segments, err := readManifest("p"); err != nil || len(segments) != 1 {
+		t.Fatalf("expected the archive to stay, got %+v %v", segments, err)
+	}
+
+	// A tombstone nobody wrote over is collected with its history
+	addr = t.TempDir()
+	storeProduct(tombstone)
+	mergeHistory("p", []common.PricePoint{{Time: start, Price: 10}})
+	if !collectTombstone(tombstone) {
+		t.Fatal("expected the tombstone to be collected")
+	}
+	if _, err := os.Stat(historyPath("p")); !os.IsNotExist(err) {
+		t.Fatalf("expected the history to be removed, got %v", err)
+	}
+}
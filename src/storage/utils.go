@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -53,6 +54,21 @@ func CheckIps() (net.IP, error) {
 	return ip, nil
 }
 
+// httpAddress converts the address of a chord node into the address of its http server
+func httpAddress(host string) string {
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+
+	intPort, err := strconv.Atoi(port)
+	if err != nil {
+		return host
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(intPort+1))
+}
+
 func TakeBytesAndTake1(b []byte) []byte {
 	hexa := hex.EncodeToString(b)
 	parseInt, err := strconv.ParseInt(hexa, 16, 64)
@@ -87,8 +103,7 @@ func SendProductRequest(product common.Product, address string) error {
 		}
 		req.Header.Set("Content-Type", "application/json")
 
-		client := &http.Client{Timeout: 10 * time.Second}
-		resp, err := client.Do(req)
+		resp, err := replicationClient.Do(req)
 		if err != nil {
 			if err == io.EOF && attempt < maxRetries-1 {
 				time.Sleep(backoff)
@@ -108,3 +123,25 @@ func SendProductRequest(product common.Product, address string) error {
 
 	return nil
 }
+
+// SendHistoryRequest sends the price points of a product to the /history endpoint of a replica
+func SendHistoryRequest(name string, points []common.PricePoint, address string) error {
+	endpoint := "http://" + address + "/history?key=" + url.QueryEscape(name)
+
+	payloadBytes, err := json.Marshal(points)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+
+	resp, err := replicationClient.Post(endpoint, "application/json", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	return nil
+}
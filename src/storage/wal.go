@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations are appended to the log before touching the data files and marked
+// as committed afterwards, or aborted when they fail. On startup the operations
+// without a commit or abort are replayed, so a crash never leaves a file half
+// written.
+const (
+	walPut    = "put"
+	walDelete = "delete"
+
+	walBegin  = "begin"
+	walCommit = "commit"
+	walAbort  = "abort"
+)
+
+// The log is truncated after this many committed operations
+const walCheckpointEvery = 1000
+
+type walRecord struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op"`
+	State string `json:"state"`
+	Path  string `json:"path"`
+	Data  []byte `json:"data,omitempty"`
+	// A line appended to the change log by the same operation, see appendChange
+	Change []byte `json:"change,omitempty"`
+}
+
+var (
+	walMutex     sync.Mutex
+	walFile      *os.File
+	walSeq       uint64
+	walCommitted int
+	// Operations applied whose change couldn't be appended to the change log,
+	// the log isn't truncated until walFinishPending appends them
+	walPending []walRecord
+)
+
+func walPath() string {
+	return filepath.Join(addr, "wal.log")
+}
+
+// writeFileAtomic writes the data to a temporary file next to the target, syncs it
+// and renames it over the target so readers see either the old or the new content
+func writeFileAtomic(fp string, data []byte) error {
+	dir := filepath.Dir(fp)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", fp, time.Now().UnixNano())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, fp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func appendWAL(record walRecord) error {
+	if walFile == nil {
+		f, err := os.OpenFile(walPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		walFile = f
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := walFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return walFile.Sync()
+}
+
+// applyOp performs an operation on a data file
+func applyOp(op string, fp string, data []byte) error {
+	switch op {
+	case walPut:
+		return writeFileAtomic(fp, data)
+	case walDelete:
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return syncDir(filepath.Dir(fp))
+	}
+	return fmt.Errorf("unknown operation %s", op)
+}
+
+func logged(op string, fp string, data []byte, change []byte) error {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	walSeq++
+	record := walRecord{Seq: walSeq, Op: op, State: walBegin, Path: fp, Data: data, Change: change}
+	if err := appendWAL(record); err != nil {
+		return fmt.Errorf("failed to append to the write-ahead log: %v", err)
+	}
+
+	if err := applyOp(op, fp, data); err != nil {
+		// The operation is not replayed on startup, it would only fail again
+		record = walRecord{Seq: walSeq, Op: op, State: walAbort, Path: fp}
+		if err := appendWAL(record); err != nil {
+			log.Printf("Failed to abort %s of %s in the write-ahead log: %v", op, fp, err)
+		}
+		return err
+	}
+
+	if change != nil {
+		if err := appendChange(change); err != nil {
+			// The file is written, the change is appended by the next
+			// write of a change or when the operation is replayed
+			walPending = append(walPending, record)
+			return fmt.Errorf("failed to append to the change log: %v", err)
+		}
+	}
+
+	return commitWAL(record)
+}
+
+// commitWAL marks the operation as committed and truncates the log once enough
+// of them are and none is pending. The caller must hold walMutex.
+func commitWAL(record walRecord) error {
+	record = walRecord{Seq: record.Seq, Op: record.Op, State: walCommit, Path: record.Path}
+	if err := appendWAL(record); err != nil {
+		return fmt.Errorf("failed to append to the write-ahead log: %v", err)
+	}
+
+	walCommitted++
+	if walCommitted >= walCheckpointEvery && len(walPending) == 0 {
+		if err := truncateWAL(); err != nil {
+			log.Printf("Failed to truncate the write-ahead log: %v", err)
+		}
+	}
+	return nil
+}
+
+// walFinishPending appends the changes of the operations that couldn't append
+// them and commits those operations. The caller must hold changesMutex, which
+// is always taken before walMutex.
+func walFinishPending() error {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	for len(walPending) > 0 {
+		record := walPending[0]
+		if err := appendChange(record.Change); err != nil {
+			return fmt.Errorf("failed to append to the change log: %v", err)
+		}
+		walPending = walPending[1:]
+		if err := commitWAL(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walWrite durably writes a data file through the write-ahead log
+func walWrite(fp string, data []byte) error {
+	return logged(walPut, fp, data, nil)
+}
+
+// walWriteChange writes a data file and appends the change to the change log in
+// the same operation, a crash never leaves one without the other. The caller
+// must hold changesMutex and have finished the pending operations first, see
+// walFinishPending.
+func walWriteChange(fp string, data []byte, change []byte) error {
+	return logged(walPut, fp, data, change)
+}
+
+// walRemove durably removes a data file through the write-ahead log
+func walRemove(fp string) error {
+	return logged(walDelete, fp, nil, nil)
+}
+
+func truncateWAL() error {
+	if walFile != nil {
+		walFile.Close()
+		walFile = nil
+	}
+	walCommitted = 0
+	walPending = nil
+	return os.Truncate(walPath(), 0)
+}
+
+// recoverWAL replays the operations that began but never finished and removes
+// the temporary files a crash may have left behind. It runs before serving. An
+// operation that can't be replayed is skipped, the file keeps its last content
+// and anti-entropy brings the product back from the replicas.
+func recoverWAL() {
+	// Same order as the writes of changes, changesMutex before walMutex
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	removeTempFiles()
+
+	f, err := os.Open(walPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to open the write-ahead log: %v", err)
+	}
+
+	pending := make(map[uint64]walRecord)
+	var order []uint64
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash while appending leaves a truncated last record, the
+			// operation never started so it is discarded
+			log.Printf("Discarding incomplete write-ahead log record")
+			continue
+		}
+
+		switch record.State {
+		case walBegin:
+			pending[record.Seq] = record
+			order = append(order, record.Seq)
+		case walCommit, walAbort:
+			delete(pending, record.Seq)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read the write-ahead log: %v", err)
+	}
+	f.Close()
+
+	for _, seq := range order {
+		record, ok := pending[seq]
+		if !ok {
+			continue
+		}
+
+		if err := applyOp(record.Op, record.Path, record.Data); err != nil {
+			log.Printf("Skipping %s of %s, it can't be replayed: %v", record.Op, record.Path, err)
+			continue
+		}
+		if record.Change != nil {
+			if err := appendChange(record.Change); err != nil {
+				log.Printf("Failed to replay the change of %s: %v", record.Path, err)
+			}
+		}
+		log.Printf("Replayed %s of %s from the write-ahead log", record.Op, record.Path)
+	}
+
+	if err := truncateWAL(); err != nil {
+		log.Fatalf("Failed to truncate the write-ahead log: %v", err)
+	}
+}
+
+func removeTempFiles() {
+	filepath.Walk(addr, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.Contains(info.Name(), ".tmp-") {
+			log.Printf("Removing leftover temporary file %s", fp)
+			os.Remove(fp)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWALReplaysUncommitted(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	fp := filepath.Join(addr, "product.json")
+
+	// A crash after logging the operation but before writing the file
+	walSeq++
+	if err := appendWAL(walRecord{Seq: walSeq, Op: walPut, State: walBegin, Path: fp, Data: []byte(`{"name":"product"}`)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	os.WriteFile(fp, []byte(`{"name":"pro`), 0644)
+	os.WriteFile(fp+".tmp-1", []byte(`{"name":"pro`), 0644)
+	walFile.Close()
+	walFile = nil
+
+	recoverWAL()
+
+	data, err := os.ReadFile(fp)
+	if err != nil || string(data) != `{"name":"product"}` {
+		t.Fatalf("expected the write to be replayed, got %s %v", data, err)
+	}
+	if _, err := os.Stat(fp + ".tmp-1"); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be removed")
+	}
+}
+
+func TestWALDiscardsTruncatedRecord(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	fp := filepath.Join(addr, "product.json")
+	os.WriteFile(fp, []byte(`{"name":"product"}`), 0644)
+	os.WriteFile(walPath(), []byte(`{"seq":1,"op":"put","state":"begin","pa`), 0644)
+
+	recoverWAL()
+
+	data, err := os.ReadFile(fp)
+	if err != nil || string(data) != `{"name":"product"}` {
+		t.Fatalf("expected the file to be untouched, got %s %v", data, err)
+	}
+}
+
+func TestWALCommittedWrite(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	fp := filepath.Join(addr, "history", "product.json")
+	if err := walWrite(fp, []byte("[]")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	data, err := os.ReadFile(fp)
+	if err != nil || string(data) != "[]" {
+		t.Fatalf("expected the file to be written, got %s %v", data, err)
+	}
+
+	if err := walRemove(fp); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be removed")
+	}
+}
+
+func TestWALSkipsFailedOperation(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	// The name is too long for the filesystem, the write fails every time
+	fp := filepath.Join(addr, strings.Repeat("a", 300)+".json")
+	if err := walWrite(fp, []byte("{}")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	walFile.Close()
+	walFile = nil
+
+	// The failed write was aborted, a crash before the abort is skipped too
+	walSeq++
+	appendWAL(walRecord{Seq: walSeq, Op: walPut, State: walBegin, Path: fp, Data: []byte("{}")})
+	walFile.Close()
+	walFile = nil
+
+	recoverWAL()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"chord"
+	common "commons"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// validateWatch checks the rule can be evaluated and its alerts delivered
+func validateWatch(rule common.WatchRule) error {
+	if (rule.Key == "") == (rule.Query == "") {
+		return fmt.Errorf("a rule needs either a key or a query")
+	}
+	if rule.Threshold <= 0 {
+		return fmt.Errorf("invalid threshold: %v", rule.Threshold)
+	}
+	if rule.Query != "" {
+		values, err := url.ParseQuery(rule.Query)
+		if err != nil {
+			return fmt.Errorf("invalid query: %v", err)
+		}
+		if _, err := parseQuery(values); err != nil {
+			return err
+		}
+	}
+	if _, ok := alertSinks[rule.Sink]; !ok {
+		return fmt.Errorf("unknown sink: %s", rule.Sink)
+	}
+	if rule.Sink != "log" && rule.Target == "" {
+		return fmt.Errorf("the %s sink needs a target", rule.Sink)
+	}
+	return nil
+}
+
+// Rules are placed on the ring under their own key, apart from the products
+func watchKey(id string) string {
+	return "watch:" + id
+}
+
+func watchesDir() string {
+	return filepath.Join(addr, "watches")
+}
+
+func watchPath(id string) string {
+	return filepath.Join(watchesDir(), keyFile(id))
+}
+
+var (
+	watchMutex sync.Mutex
+	// Every rule of the cluster this node knows about, the ones it owns are
+	// also on disk. It is loaded on first use and refreshed by WatchSync.
+	knownWatches map[string]common.WatchRule
+)
+
+func readLocalWatches() ([]common.WatchRule, error) {
+	files, err := os.ReadDir(watchesDir())
+	if os.IsNotExist(err) {
+		return []common.WatchRule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []common.WatchRule{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(watchesDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var rule common.WatchRule
+		if err := json.Unmarshal(data, &rule); err != nil {
+			log.Printf("Skipping unreadable watch rule %s: %v", file.Name(), err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// loadWatches fills the cache from disk the first time, the caller must hold
+// watchMutex
+func loadWatches() {
+	if knownWatches != nil {
+		return
+	}
+
+	knownWatches = make(map[string]common.WatchRule)
+	rules, err := readLocalWatches()
+	if err != nil {
+		log.Printf("Failed to read watch rules: %v", err)
+	}
+	for _, rule := range rules {
+		knownWatches[rule.ID] = rule
+	}
+}
+
+// rememberWatch keeps the rule in the cache unless a newer version is known, the
+// caller must hold watchMutex. It returns whether the rule was newer.
+func rememberWatch(rule common.WatchRule) bool {
+	loadWatches()
+
+	if current, ok := knownWatches[rule.ID]; ok && current.Version.Compare(rule.Version) >= 0 {
+		return false
+	}
+	knownWatches[rule.ID] = rule
+	return true
+}
+
+// storeWatch writes a rule this node owns unless the local copy is at least as new
+func storeWatch(rule common.WatchRule) (bool, error) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+
+	if !rememberWatch(rule) {
+		return false, nil
+	}
+
+	data, err := json.MarshalIndent(rule, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, walWrite(watchPath(rule.ID), data)
+}
+
+// activeWatches returns the rules that haven't been removed
+func activeWatches() []common.WatchRule {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+
+	loadWatches()
+
+	rules := []common.WatchRule{}
+	for _, rule := range knownWatches {
+		if !rule.Deleted {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Created.Before(rules[j].Created)
+	})
+	return rules
+}
+
+func sendWatch(rule common.WatchRule, host string) error {
+	payload, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	resp, err := antiEntropyClient.Post("http://"+httpAddress(host)+"/watch/replicate", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeWatch sends the rule to the owners of its key and returns how many of them
+// acknowledged it
+func writeWatch(ring *chord.Ring, rule common.WatchRule) int {
+	owners, err := ownersOf(ring, watchKey(rule.ID), replicaCount())
+	if err != nil {
+		log.Printf("Failed to look up the owners of watch rule %s: %v", rule.ID, err)
+		return 0
+	}
+
+	acks := 0
+	for _, owner := range owners {
+		if err := sendWatch(rule, owner); err != nil {
+			log.Printf("Failed to send watch rule %s to %s: %v", rule.ID, owner, err)
+			continue
+		}
+		acks++
+	}
+
+	// The rest of the cluster learns about it on its next sync, remember it here
+	// so it is evaluated right away
+	watchMutex.Lock()
+	rememberWatch(rule)
+	watchMutex.Unlock()
+
+	return acks
+}
+
+// newID returns a random id for rules and archive segments
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validID tells if the id has the form newID gives them, ids from the network
+// end up in file names
+func validID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 8
+}
+
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var rules []common.WatchRule
+		if r.URL.Query().Get("scope") == "local" {
+			// Removed rules are included so they are synced too
+			var err error
+			if rules, err = readLocalWatches(); err != nil {
+				http.Error(w, "Failed to read watch rules", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			syncWatches(ring)
+			rules = activeWatches()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	case http.MethodPost:
+		var rule common.WatchRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if rule.Sink == "" {
+			rule.Sink = "log"
+		}
+		if err := validateWatch(rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule.ID = newID()
+		rule.Created = time.Now().UTC()
+		rule.Version = clock.Now()
+		rule.Deleted = false
+
+		if acks := writeWatch(ring, rule); acks < writeQuorum() {
+			http.Error(w, fmt.Sprintf("Write quorum not reached: %d/%d acknowledgements", acks, writeQuorum()), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !validID(id) {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		rule := common.WatchRule{ID: id, Deleted: true, Version: clock.Now()}
+		if acks := writeWatch(ring, rule); acks < writeQuorum() {
+			http.Error(w, fmt.Sprintf("Write quorum not reached: %d/%d acknowledgements", acks, writeQuorum()), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// watchReplicateHandler stores a rule sent by the node coordinating its write
+func watchReplicateHandler(w http.ResponseWriter, r *http.Request) {
+	var rule common.WatchRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil || !validID(rule.ID) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	clock.Observe(rule.Version)
+	if _, err := storeWatch(rule); err != nil {
+		log.Printf("Failed to store watch rule %s: %v", rule.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// syncWatches learns the rules owned by the rest of the cluster, every node needs
+// all of them since any node may coordinate a write to a watched product
+func syncWatches(ring *chord.Ring) {
+	for _, host := range clusterHosts(ring) {
+		if host == addr {
+			continue
+		}
+
+		var rules []common.WatchRule
+		if err := getJSON("http://"+httpAddress(host)+"/watch?scope=local", &rules); err != nil {
+			log.Printf("Failed to sync watch rules from %s: %v", host, err)
+			continue
+		}
+
+		watchMutex.Lock()
+		for _, rule := range rules {
+			rememberWatch(rule)
+		}
+		watchMutex.Unlock()
+	}
+}
+
+func WatchSync(ring *chord.Ring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		syncWatches(ring)
+	}
+}
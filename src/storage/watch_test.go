@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	common "commons"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchRuleValidate(t *testing.T) {
+	valid := []common.WatchRule{
+		{Key: "product", Threshold: 100, Sink: "log"},
+		{Query: "category=gpu&source=newegg", Threshold: 300, Sink: "webhook", Target: "http://example.com/hook"},
+	}
+	for _, rule := range valid {
+		if err := validateWatch(rule); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", rule, err)
+		}
+	}
+
+	invalid := []common.WatchRule{
+		{Threshold: 100, Sink: "log"},
+		{Key: "product", Query: "source=newegg", Threshold: 100, Sink: "log"},
+		{Key: "product", Sink: "log"},
+		{Key: "product", Threshold: 100, Sink: "email"},
+		{Key: "product", Threshold: 100, Sink: "queue"},
+		{Query: "sort=color", Threshold: 100, Sink: "log"},
+	}
+	for _, rule := range invalid {
+		if err := validateWatch(rule); err == nil {
+			t.Fatalf("expected %+v to be invalid", rule)
+		}
+	}
+}
+
+func TestWatchRuleMatchesAndDrops(t *testing.T) {
+	rule := common.WatchRule{Query: "category=gpu&source=newegg", Threshold: 300, Sink: "log"}
+
+	product := common.Product{
+		Name:   "MSI GeForce RTX 4060",
+		Source: "newegg",
+		Price:  289.99,
+		URL:    "https://www.newegg.com/p/N82E16814137797",
+	}
+	if !watches(rule, product) {
+		t.Fatalf("expected the rule to watch the product")
+	}
+
+	if !priceDropped(rule, product, nil) {
+		t.Fatalf("expected a new product under the threshold to raise an alert")
+	}
+
+	previous := product
+	previous.Price = 349.99
+	if !priceDropped(rule, product, &previous) {
+		t.Fatalf("expected crossing the threshold to raise an alert")
+	}
+
+	previous.Price = 279.99
+	if priceDropped(rule, product, &previous) {
+		t.Fatalf("expected a price increase not to raise an alert")
+	}
+
+	product.Price = 0
+	if priceDropped(rule, product, nil) {
+		t.Fatalf("expected a product without price not to raise an alert")
+	}
+}
+
+func TestWatchReplicateRejectsTraversalID(t *testing.T) {
+	addr = t.TempDir()
+	defer truncateWAL()
+
+	for _, id := range []string{"../victim", "", "0a1b"} {
+		payload, _ := json.Marshal(common.WatchRule{ID: id, Key: "product", Threshold: 10, Sink: "log"})
+		recorder := httptest.NewRecorder()
+		watchReplicateHandler(recorder, httptest.NewRequest(http.MethodPost, "/watch/replicate", bytes.NewReader(payload)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("expected rule id %q to be rejected, got %d", id, recorder.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(addr, "victim.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written outside the watch directory, got %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	watchHandler(recorder, httptest.NewRequest(http.MethodDelete, "/watch?id=..%2Fvictim", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected the removal to be rejected, got %d", recorder.Code)
+	}
+}
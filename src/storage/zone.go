@@ -0,0 +1,81 @@
+package main
+
+import (
+	"chord"
+	"log"
+	"os"
+)
+
+// zone is the failure domain of this node (a rack, a zone, a data center) set
+// with the ZONE environment variable. Replicas of a key are spread over as many
+// zones as possible so losing one of them doesn't lose every copy.
+var zone string
+
+// The zone is advertised with the vnodes of the node under this metadata key, so
+// every node learns it from the ring itself and places replicas the same way
+const zoneMeta = "zone"
+
+func loadZoneConfig() {
+	zone = os.Getenv("ZONE")
+	if zone == "" {
+		log.Printf("No zone configured, replicas are only spread across hosts")
+		return
+	}
+	log.Printf("Zone %s", zone)
+}
+
+// placementZone is the zone used to spread replicas. A host without a zone is a
+// zone of its own, so clusters without zones place replicas like before.
+func placementZone(vnode *chord.Vnode) string {
+	if z := vnode.Meta[zoneMeta]; z != "" {
+		return "zone:" + z
+	}
+	return "host:" + vnode.Host
+}
+
+// successorHosts returns the hosts of the successors in ring order without
+// duplicates, and the placement zone of each one
+func successorHosts(successors []*chord.Vnode) ([]string, map[string]string) {
+	var hosts []string
+	zones := make(map[string]string)
+	for _, succ := range successors {
+		if contains(hosts, succ.Host) {
+			continue
+		}
+		hosts = append(hosts, succ.Host)
+		zones[succ.Host] = placementZone(succ)
+	}
+	return hosts, zones
+}
+
+// placeReplicas picks amount hosts out of the successors of a key, which come in
+// ring order without duplicates. The primary is always the first successor, the
+// next ones are the first successors of the zones not covered yet. When there are
+// fewer zones than replicas the rest are filled in ring order.
+func placeReplicas(successors []string, amount int, zoneOf func(string) string) []string {
+	var result []string
+	covered := make(map[string]bool)
+
+	for _, host := range successors {
+		if len(result) == amount {
+			return result
+		}
+		z := zoneOf(host)
+		if covered[z] {
+			continue
+		}
+		covered[z] = true
+		result = append(result, host)
+	}
+
+	for _, host := range successors {
+		if len(result) == amount {
+			break
+		}
+		if !contains(result, host) {
+			result = append(result, host)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"chord"
+	"reflect"
+	"testing"
+)
+
+func TestPlaceReplicasSpreadsZones(t *testing.T) {
+	zones := map[string]string{"a1": "a", "a2": "a", "b1": "b", "a3": "a", "c1": "c"}
+	zoneOf := func(host string) string { return zones[host] }
+
+	successors := []string{"a1", "a2", "b1", "a3", "c1"}
+
+	if owners := placeReplicas(successors, 3, zoneOf); !reflect.DeepEqual(owners, []string{"a1", "b1", "c1"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+	// More replicas than zones, the rest follow the ring order
+	if owners := placeReplicas(successors, 4, zoneOf); !reflect.DeepEqual(owners, []string{"a1", "b1", "c1", "a2"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+	if owners := placeReplicas(successors, 1, zoneOf); !reflect.DeepEqual(owners, []string{"a1"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+}
+
+func TestPlaceReplicasWithoutZones(t *testing.T) {
+	successors := []string{"h1", "h2", "h3", "h4"}
+
+	// Hosts without a zone are zones of their own, placement is the ring order
+	zoneOf := func(host string) string { return "host:" + host }
+	if owners := placeReplicas(successors, 3, zoneOf); !reflect.DeepEqual(owners, []string{"h1", "h2", "h3"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+	if owners := placeReplicas(successors[:2], 3, zoneOf); !reflect.DeepEqual(owners, []string{"h1", "h2"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+}
+
+func TestSuccessorHostsReadsAdvertisedZones(t *testing.T) {
+	successors := []*chord.Vnode{
+		{Host: "h1", Meta: map[string]string{zoneMeta: "a"}},
+		{Host: "h2"},
+		{Host: "h1", Meta: map[string]string{zoneMeta: "a"}},
+		{Host: "h3", Meta: map[string]string{zoneMeta: "b"}},
+	}
+
+	hosts, zones := successorHosts(successors)
+	if !reflect.DeepEqual(hosts, []string{"h1", "h2", "h3"}) {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	// Nodes running without a zone advertise none
+	if zones["h1"] != "zone:a" || zones["h2"] != "host:h2" || zones["h3"] != "zone:b" {
+		t.Fatalf("unexpected zones %v", zones)
+	}
+}